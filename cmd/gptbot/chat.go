@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/jopbrown/gptbot/pkg/chatbot"
+)
+
+const chatBotPath = "/terminal"
+
+// chat chats with the role in the terminal, the bots of the config are not
+// served.
+func chat(args []string) error {
+	fs, cfgFile := newFlagSet("chat")
+	role := fs.String("role", "", "the role to chat with (required)")
+	userName := fs.String("user", "user", "the name of the first user")
+	group := fs.Bool("group", false, "simulate a chat group, switch the users by ':user NAME'")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 || *role == "" {
+		return errUsage
+	}
+
+	cfg, err := cfgs.Load(*cfgFile)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	cfg.Bots = map[string]*cfgs.Bot{
+		chatBotPath: {Platform: cfgs.PlatformTerminal, DefaultRole: *role},
+	}
+	// do not mix the sessions of the terminal into the served ones
+	cfg.SessionStore = cfgs.SessionStoreMemory
+	err = cfg.Validate()
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	// keep the terminal for the chat
+	err = applyLog(cfg, false)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	bot, err := chatbot.NewBot(cfg)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	go bot.DoTasks()
+	defer bot.Stop()
+
+	return bot.Chat(os.Stdin, os.Stdout, &chatbot.ChatOptions{
+		BotPath:  chatBotPath,
+		UserName: *userName,
+		Group:    *group,
+	})
+}
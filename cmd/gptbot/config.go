@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+)
+
+// checkConfig validates the config without starting the server.
+func checkConfig(args []string) error {
+	fs, cfgFile := newFlagSet("config check")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errUsage
+	}
+
+	cfg, err := cfgs.Load(*cfgFile)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	fmt.Printf("%s is valid\n", *cfgFile)
+	return nil
+}
+
+// dumpConfig prints the config with the secrets masked.
+func dumpConfig(args []string) error {
+	fs, cfgFile := newFlagSet("config dump")
+	effective := fs.Bool("effective", false, "merge the default config")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errUsage
+	}
+
+	var cfg *cfgs.Config
+	if *effective {
+		cfg, err = cfgs.Load(*cfgFile)
+	} else {
+		cfg, err = cfgs.LoadConfig(*cfgFile)
+	}
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	return cfg.WriteConfig(os.Stdout)
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
 	"path/filepath"
 	"time"
 
@@ -9,7 +12,6 @@ import (
 	"github.com/jopbrown/gobase/log"
 	"github.com/jopbrown/gobase/log/rotate"
 	"github.com/jopbrown/gptbot/pkg/cfgs"
-	"github.com/jopbrown/gptbot/pkg/chatbot"
 )
 
 var (
@@ -19,50 +21,116 @@ var (
 	BuildTime    = "20060102150405"
 )
 
+const usage = `Usage: gptbot <command> [flags]
+
+Commands:
+    serve                       serve the bots, it is the default command
+    config check                validate the config
+    config dump [--effective]   print the config, merged with the default config if --effective
+    roles list                  list the roles
+    roles show <name>           print the role
+    chat --role <name>          chat with the role in the terminal, --group simulates a chat group
+    version                     print the version
+
+Run 'gptbot <command> -h' for the flags of the command.
+`
+
+// errUsage fails the command with the usage printed.
+var errUsage = errors.Error("invalid usage")
+
 func main() {
-	err := run()
+	err := runCommand(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if errors.Is(err, errUsage) {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if verr, ok := errors.AsIs[*cfgs.ValidationError](err); ok {
+		fmt.Fprintln(os.Stderr, verr)
+		os.Exit(1)
+	}
 	if err != nil {
 		log.Fatal(errors.GetErrorDetails(err))
 	}
 }
 
-func run() error {
-	cfg, err := cfgs.LoadConfig(filepath.Join(fsutil.AppDir(), "gptbot.yaml"))
-	if err != nil {
-		return errors.ErrorAt(err)
+func runCommand(args []string) error {
+	if len(args) == 0 {
+		return serve(nil)
 	}
-	cfg.MergeDefault()
 
-	err = applyLog(cfg)
-	if err != nil {
-		return errors.ErrorAt(err)
+	cmd, args := args[0], args[1:]
+	sub := ""
+	if len(args) != 0 {
+		sub = args[0]
 	}
-	cfg.WriteConfig(log.GetWriter(log.LevelDebug))
-
-	log.Infof("%s %v-%v-%v", BuildName, BuildVersion, BuildHash, BuildTime)
 
-	bot, err := chatbot.NewBot(cfg)
-	if err != nil {
-		return errors.ErrorAt(err)
+	switch {
+	case cmd == "serve":
+		return serve(args)
+	case cmd == "config" && sub == "check":
+		return checkConfig(args[1:])
+	case cmd == "config" && sub == "dump":
+		return dumpConfig(args[1:])
+	case cmd == "roles" && sub == "list":
+		return listRoles(args[1:])
+	case cmd == "roles" && sub == "show":
+		return showRole(args[1:])
+	case cmd == "chat":
+		return chat(args)
+	case cmd == "version":
+		fmt.Printf("%s %s\nhash: %s\ntime: %s\n", BuildName, BuildVersion, BuildHash, BuildTime)
+		return nil
+	case cmd == "help", cmd == "-h", cmd == "--help":
+		fmt.Print(usage)
+		return nil
 	}
 
-	err = bot.Serve()
-	if err != nil {
-		return errors.ErrorAt(err)
-	}
+	return errUsage
+}
 
-	return nil
+// newFlagSet returns the flags of the command with --config.
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("gptbot "+name, flag.ContinueOnError)
+	cfgFile := fs.String("config", filepath.Join(fsutil.AppDir(), "gptbot.yaml"), "path of the config file")
+	return fs, cfgFile
+}
+
+// parseFlags parses the flags mixed with the positional arguments, and returns
+// the positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
 }
 
-func applyLog(cfg *cfgs.Config) error {
+// applyLog logs to the log file, and to the console if console is true.
+func applyLog(cfg *cfgs.Config, console bool) error {
 	f, err := rotate.OpenFile(filepath.Join(cfg.LogPath, "gptbot.log"), 24*time.Hour, 0)
 	if err != nil {
 		return errors.ErrorAt(err)
 	}
 
+	fileLogger := log.FileLogger(f, log.FileLoggerFormat(), cfg.DebugMode)
+	if !console {
+		log.SetGlobalLogger(fileLogger)
+		return nil
+	}
+
 	tee := log.NewTeeLogger(
 		log.ConsoleLogger(cfg.DebugMode),
-		log.FileLogger(f, log.FileLoggerFormat(), cfg.DebugMode),
+		fileLogger,
 	)
 
 	log.SetGlobalLogger(tee)
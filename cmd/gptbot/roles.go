@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// listRoles prints the roles of the effective config with their models.
+func listRoles(args []string) error {
+	fs, cfgFile := newFlagSet("roles list")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errUsage
+	}
+
+	cfg, err := cfgs.Load(*cfgFile)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	names := maps.Keys(cfg.Roles)
+	slices.Sort(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPROVIDER\tMODEL\tPROMPT")
+	for _, name := range names {
+		role := cfg.Roles[name]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, orDefault(role.Provider), orDefault(role.Model), summarizePrompt(role.Prompt, 40))
+	}
+	return w.Flush()
+}
+
+// showRole prints the role of the effective config in yaml.
+func showRole(args []string) error {
+	fs, cfgFile := newFlagSet("roles show")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errUsage
+	}
+
+	cfg, err := cfgs.Load(*cfgFile)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	name := positional[0]
+	role, ok := cfg.Roles[name]
+	if !ok {
+		return errors.Errorf("role not found: %s", name)
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	defer enc.Close()
+	return enc.Encode(cfgs.Roles{name: role})
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// summarizePrompt returns the first line of the prompt in at most n runes.
+func summarizePrompt(prompt string, n int) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(prompt), "\n")
+	runes := []rune(line)
+	if len(runes) > n {
+		return string(runes[:n]) + "…"
+	}
+	return line
+}
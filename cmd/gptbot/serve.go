@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/jopbrown/gptbot/pkg/chatbot"
+)
+
+func serve(args []string) error {
+	fs, cfgFile := newFlagSet("serve")
+	port := fs.Int("port", 0, "override ServePort")
+	logDir := fs.String("log-dir", "", "override LogPath")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errUsage
+	}
+
+	// the flags also override the reloaded configs
+	override := func(cfg *cfgs.Config) {
+		if *port != 0 {
+			cfg.ServePort = *port
+		}
+		if *logDir != "" {
+			cfg.LogPath = *logDir
+		}
+	}
+
+	cfg, err := cfgs.Load(*cfgFile)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	override(cfg)
+	err = cfg.Validate()
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	err = applyLog(cfg, true)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	cfg.WriteConfig(log.GetWriter(log.LevelDebug))
+
+	log.Infof("%s %v-%v-%v", BuildName, BuildVersion, BuildHash, BuildTime)
+
+	bot, err := chatbot.NewBot(cfg)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	go bot.WatchConfig(*cfgFile, override)
+	go stopOnSignal(bot)
+
+	err = bot.Serve()
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	return nil
+}
+
+// stopOnSignal stops the bot gracefully on SIGINT or SIGTERM, and exits at once
+// on the second one.
+func stopOnSignal(bot *chatbot.Bot) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigs
+	log.Infof("receive %v, stop gracefully, send it again to exit at once", sig)
+	bot.Stop()
+
+	sig = <-sigs
+	log.Warnf("receive %v again, exit at once", sig)
+	os.Exit(1)
+}
@@ -1,6 +1,7 @@
 package cfgs
 
 import (
+	"bytes"
 	"embed"
 	"io"
 	"os"
@@ -14,26 +15,143 @@ import (
 )
 
 type Config struct {
-	DebugMode            bool            `yaml:"DebugMode"`
-	ChatGptApiUrl        string          `yaml:"ChatGptApiUrl"`
-	ChatGptAccessToken   string          `yaml:"ChatGptAccessToken"`
-	ChatGptModel         string          `yaml:"ChatGptModel"`
-	SessionExpirePeriod  time.Duration   `yaml:"SessionExpirePeriod"`
-	SessionClearInterval time.Duration   `yaml:"SessionClearInterval"`
-	Bots                 map[string]*Bot `yaml:"Bots"`
-	Roles                Roles           `yaml:"Roles"`
-	ServePort            int             `yaml:"ServePort"`
-	MaxTaskQueueCap      int             `yaml:"MaxTaskQueueCap"`
-	LogPath              string          `yaml:"LogPath"`
-	CmdsTalkToAI         []string        `yaml:"CmdsTalkToAI"`
-	CmdsClearSession     []string        `yaml:"CmdsClearSession"`
-	CmdsChangeRole       []string        `yaml:"CmdsChangeRole"`
+	DebugMode             bool                 `yaml:"DebugMode"`
+	ChatGptApiUrl         string               `yaml:"ChatGptApiUrl"`
+	ChatGptAccessToken    string               `yaml:"ChatGptAccessToken"`
+	ChatGptModel          string               `yaml:"ChatGptModel"`
+	SessionExpirePeriod   time.Duration        `yaml:"SessionExpirePeriod"`
+	SessionClearInterval  time.Duration        `yaml:"SessionClearInterval"`
+	SessionStore          string               `yaml:"SessionStore"`
+	ImageHoldPeriod       time.Duration        `yaml:"ImageHoldPeriod"`
+	TranscriptionApiUrl   string               `yaml:"TranscriptionApiUrl"`
+	TranscriptionModel    string               `yaml:"TranscriptionModel"`
+	TtsApiUrl             string               `yaml:"TtsApiUrl"`
+	TtsModel              string               `yaml:"TtsModel"`
+	TtsVoice              string               `yaml:"TtsVoice"`
+	ImageApiUrl           string               `yaml:"ImageApiUrl"`
+	ImageModel            string               `yaml:"ImageModel"`
+	ImageSize             string               `yaml:"ImageSize"`
+	PublicUrl             string               `yaml:"PublicUrl"`
+	MediaExpirePeriod     time.Duration        `yaml:"MediaExpirePeriod"`
+	Providers             map[string]*Provider `yaml:"Providers"`
+	Fallbacks             []*Fallback          `yaml:"Fallbacks"`
+	RetryCount            int                  `yaml:"RetryCount"`
+	RetryBackoff          time.Duration        `yaml:"RetryBackoff"`
+	RequestTimeout        time.Duration        `yaml:"RequestTimeout"`
+	CircuitBreakThreshold int                  `yaml:"CircuitBreakThreshold"`
+	CircuitBreakCooldown  time.Duration        `yaml:"CircuitBreakCooldown"`
+	ApiTokens             []string             `yaml:"ApiTokens"`
+	ApiDefaultRole        string               `yaml:"ApiDefaultRole"`
+	AdminToken            string               `yaml:"AdminToken"`
+	AdminUser             string               `yaml:"AdminUser"`
+	AdminPassword         string               `yaml:"AdminPassword"`
+	RateLimits            *RateLimits          `yaml:"RateLimits"`
+	Bots                  map[string]*Bot      `yaml:"Bots"`
+	Roles                 Roles                `yaml:"Roles"`
+	RolesFile             string               `yaml:"RolesFile"`
+	ConfigWatchInterval   time.Duration        `yaml:"ConfigWatchInterval"`
+	ServePort             int                  `yaml:"ServePort"`
+	ShutdownTimeout       time.Duration        `yaml:"ShutdownTimeout"`
+	MaxTaskQueueCap       int                  `yaml:"MaxTaskQueueCap"`
+	QueueOverloadPolicy   string               `yaml:"QueueOverloadPolicy"`
+	TaskWorkerCount       int                  `yaml:"TaskWorkerCount"`
+	LogPath               string               `yaml:"LogPath"`
+	CmdsTalkToAI          []string             `yaml:"CmdsTalkToAI"`
+	CmdsClearSession      []string             `yaml:"CmdsClearSession"`
+	CmdsChangeRole        []string             `yaml:"CmdsChangeRole"`
+	CmdsShowSummary       []string             `yaml:"CmdsShowSummary"`
+	CmdsDrawImage         []string             `yaml:"CmdsDrawImage"`
+	CmdsShowQuota         []string             `yaml:"CmdsShowQuota"`
+
+	// sources are the loaded files, they locate the settings for Validate
+	sources []*source
 }
 
 type Bot struct {
-	DefaultRole       string `yaml:"DefaultRole"`
-	LineChannelToken  string `yaml:"LineChannelToken"`
-	LineChannelSecret string `yaml:"LineChannelSecret"`
+	Platform            string `yaml:"Platform"`
+	DefaultRole         string `yaml:"DefaultRole"`
+	Provider            string `yaml:"Provider"`
+	Model               string `yaml:"Model"`
+	LineChannelToken    string `yaml:"LineChannelToken"`
+	LineChannelSecret   string `yaml:"LineChannelSecret"`
+	TelegramToken       string `yaml:"TelegramToken"`
+	TelegramApiUrl      string `yaml:"TelegramApiUrl"`
+	TelegramMode        string `yaml:"TelegramMode"`
+	TelegramWebhookUrl  string `yaml:"TelegramWebhookUrl"`
+	TelegramSecretToken string `yaml:"TelegramSecretToken"`
+	RateLimit           *Limit `yaml:"RateLimit"`
+}
+
+const (
+	PlatformLine     = "line"
+	PlatformTelegram = "telegram"
+	// PlatformTerminal chats in the terminal by `gptbot chat`
+	PlatformTerminal = "terminal"
+
+	TelegramModeWebhook = "webhook"
+	TelegramModePoll    = "poll"
+)
+
+func (bot *Bot) GetPlatform() string {
+	if bot.Platform == "" {
+		return PlatformLine
+	}
+	return bot.Platform
+}
+
+// Provider is a LLM service. Model is the default model of the provider.
+// ApiVersion is required by Azure OpenAI and Anthropic.
+type Provider struct {
+	Type        string `yaml:"Type"`
+	ApiUrl      string `yaml:"ApiUrl"`
+	AccessToken string `yaml:"AccessToken"`
+	ApiVersion  string `yaml:"ApiVersion"`
+	Model       string `yaml:"Model"`
+}
+
+// Fallback is a provider and model to try when the previous one fails, the
+// empty ones are resolved like the provider and model of the role.
+type Fallback struct {
+	Provider string `yaml:"Provider"`
+	Model    string `yaml:"Model"`
+}
+
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAzure     = "azure"
+	ProviderAnthropic = "anthropic"
+	ProviderOllama    = "ollama"
+
+	// DefaultProvider is the provider of ChatGptApiUrl and ChatGptAccessToken
+	// unless it is defined in Providers.
+	DefaultProvider = "default"
+)
+
+func (p *Provider) GetType() string {
+	if p.Type == "" {
+		return ProviderOpenAI
+	}
+	return p.Type
+}
+
+// GetProvider returns the provider of the name, the empty name means the
+// default provider.
+func (cfg *Config) GetProvider(name string) (*Provider, bool) {
+	if name == "" {
+		name = DefaultProvider
+	}
+	if p, ok := cfg.Providers[name]; ok {
+		return p, true
+	}
+	if name == DefaultProvider {
+		return &Provider{
+			Type:        ProviderOpenAI,
+			ApiUrl:      cfg.ChatGptApiUrl,
+			AccessToken: cfg.ChatGptAccessToken,
+			Model:       cfg.ChatGptModel,
+		}, true
+	}
+	return nil, false
 }
 
 //go:embed default
@@ -54,7 +172,45 @@ func LoadConfig(fname string) (*Config, error) {
 	}
 	defer f.Close()
 
-	cfg, err := ReadConfig(f)
+	cfg, err := readConfig(f, fname)
+	if err != nil {
+		return nil, errors.ErrorAtf(err, "invalid config: %s", fname)
+	}
+
+	err = cfg.ApplyEnv()
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	return cfg, nil
+}
+
+// Load loads the config file with the roles of RolesFile, which is relative to
+// the config file, and merges the default config. The roles in the config file
+// override the ones in RolesFile.
+func Load(fname string) (*Config, error) {
+	cfg, err := LoadConfig(fname)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	if rolesFile := cfg.GetRolesFile(fname); rolesFile != "" {
+		roles, src, err := loadRoles(rolesFile)
+		if err != nil {
+			return nil, errors.ErrorAt(err)
+		}
+		cfg.sources = append(cfg.sources, src)
+		if cfg.Roles == nil {
+			cfg.Roles = Roles{}
+		}
+		for name, role := range roles {
+			if _, ok := cfg.Roles[name]; !ok {
+				cfg.Roles[name] = role
+			}
+		}
+	}
+
+	err = cfg.MergeDefault()
 	if err != nil {
 		return nil, errors.ErrorAt(err)
 	}
@@ -62,12 +218,33 @@ func LoadConfig(fname string) (*Config, error) {
 	return cfg, nil
 }
 
+// GetRolesFile returns the path of RolesFile relative to the config file,
+// empty if there is no roles file.
+func (cfg *Config) GetRolesFile(cfgFile string) string {
+	if cfg.RolesFile == "" || filepath.IsAbs(cfg.RolesFile) {
+		return cfg.RolesFile
+	}
+	return filepath.Join(filepath.Dir(cfgFile), cfg.RolesFile)
+}
+
+// ReadConfig reads the config with the variables like ${env.VARNAME} and
+// ${file:/path} expanded.
 func ReadConfig(r io.Reader) (*Config, error) {
+	return readConfig(r, "")
+}
+
+func readConfig(r io.Reader, fname string) (*Config, error) {
+	dir := ""
+	if fname != "" {
+		dir = filepath.Dir(fname)
+	}
+
 	cfg := &Config{}
-	err := yaml.NewDecoder(r).Decode(cfg)
+	node, err := decodeExpanded(yaml.NewDecoder(r), cfg, dir)
 	if err != nil {
 		return nil, errors.ErrorAt(err)
 	}
+	cfg.sources = []*source{{fname: fname, node: node}}
 
 	return cfg, nil
 }
@@ -81,7 +258,12 @@ func (cfg *Config) Merge(cfg2 *Config) error {
 }
 
 func (cfg *Config) MergeDefault() error {
-	return cfg.Merge(DefaultConfig())
+	defCfg := DefaultConfig()
+	// the default bot is only a placeholder, do not mix it into user defined bots
+	if len(cfg.Bots) != 0 {
+		defCfg.Bots = nil
+	}
+	return cfg.Merge(defCfg)
 }
 
 func (cfg *Config) SaveConfig(fname string) error {
@@ -91,7 +273,7 @@ func (cfg *Config) SaveConfig(fname string) error {
 	}
 	defer f.Close()
 
-	err = cfg.WriteConfig(f)
+	err = yaml.NewEncoder(f).Encode(cfg)
 	if err != nil {
 		return errors.ErrorAt(err)
 	}
@@ -99,8 +281,17 @@ func (cfg *Config) SaveConfig(fname string) error {
 	return nil
 }
 
+// Equal reports whether the settings are the same, regardless of the files
+// which they are loaded from.
+func (cfg *Config) Equal(cfg2 *Config) bool {
+	data1, err1 := yaml.Marshal(cfg)
+	data2, err2 := yaml.Marshal(cfg2)
+	return err1 == nil && err2 == nil && bytes.Equal(data1, data2)
+}
+
+// WriteConfig writes the config with the secrets masked, e.g. to the logs.
 func (cfg *Config) WriteConfig(w io.Writer) error {
-	err := yaml.NewEncoder(w).Encode(cfg)
+	err := yaml.NewEncoder(w).Encode(cfg.Masked())
 	if err != nil {
 		return errors.ErrorAt(err)
 	}
@@ -1,9 +1,94 @@
 package cfgs
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestLoadConfig(t *testing.T) {
 	DefaultConfig().SaveConfig("tmp/config.yaml")
 }
+
+func TestLoadConfig_Expand(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "line_secret"), []byte("secret\n"), 0o600)
+	os.WriteFile(filepath.Join(dir, "gptbot.yaml"), []byte(`
+ChatGptAccessToken: ${env.TEST_GPTBOT_TOKEN}
+AdminToken: ${env.TEST_GPTBOT_PIN}
+MaxTaskQueueCap: ${env.TEST_GPTBOT_CAP}
+AdminUser: "${env.TEST_GPTBOT_CAP}"
+Bots:
+    /linebot:
+        LineChannelToken: token-${env.TEST_GPTBOT_TOKEN}
+        LineChannelSecret: ${file:line_secret}
+Roles:
+    Role:
+        Prompt: "Hello ${env.TEST_GPTBOT_NAME}"
+`), 0o600)
+	t.Setenv("TEST_GPTBOT_TOKEN", "sk-123")
+	t.Setenv("TEST_GPTBOT_NAME", "gptbot")
+	t.Setenv("TEST_GPTBOT_PIN", "0123")
+	t.Setenv("TEST_GPTBOT_CAP", "8")
+	t.Setenv("GPTBOT_SERVE_PORT", "9999")
+	t.Setenv("GPTBOT_CHAT_GPT_MODEL", "gpt-4o")
+	t.Setenv("GPTBOT_CMDS_TALK_TO_AI", "[/ai, /gpt]")
+	t.Setenv("GPTBOT_SESSION_EXPIRE_PERIOD", "1h")
+
+	cfg, err := LoadConfig(filepath.Join(dir, "gptbot.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "sk-123", cfg.ChatGptAccessToken)
+	assert.Equal(t, "token-sk-123", cfg.Bots["/linebot"].LineChannelToken)
+	assert.Equal(t, "secret", cfg.Bots["/linebot"].LineChannelSecret)
+	assert.Equal(t, "Hello gptbot", cfg.Roles["Role"].Prompt)
+	// the plain values are resolved after the expansion
+	assert.Equal(t, "0123", cfg.AdminToken)
+	assert.Equal(t, 8, cfg.MaxTaskQueueCap)
+	assert.Equal(t, "8", cfg.AdminUser)
+	assert.Equal(t, 9999, cfg.ServePort)
+	assert.Equal(t, "gpt-4o", cfg.ChatGptModel)
+	assert.Equal(t, []string{"/ai", "/gpt"}, cfg.CmdsTalkToAI)
+	assert.Equal(t, time.Hour, cfg.SessionExpirePeriod)
+
+	_, err = ReadConfig(strings.NewReader("ChatGptAccessToken: ${env.TEST_GPTBOT_UNSET}"))
+	assert.ErrorContains(t, err, "TEST_GPTBOT_UNSET")
+}
+
+func TestConfig_WriteConfig(t *testing.T) {
+	cfg := &Config{
+		ChatGptAccessToken: "sk-123",
+		Providers:          map[string]*Provider{"azure": {AccessToken: "azure-key"}},
+		Bots:               map[string]*Bot{"/linebot": {LineChannelToken: "line-token", LineChannelSecret: "line-secret"}},
+	}
+
+	w := &bytes.Buffer{}
+	assert.NoError(t, cfg.WriteConfig(w))
+	for _, secret := range []string{"sk-123", "azure-key", "line-token", "line-secret"} {
+		assert.NotContains(t, w.String(), secret)
+	}
+	assert.Equal(t, "sk-123", cfg.ChatGptAccessToken)
+}
+
+func Test_toUpperSnake(t *testing.T) {
+	assert.Equal(t, "CHAT_GPT_API_URL", toUpperSnake("ChatGptApiUrl"))
+	assert.Equal(t, "SERVE_PORT", toUpperSnake("ServePort"))
+	assert.Equal(t, "CMDS_TALK_TO_AI", toUpperSnake("CmdsTalkToAI"))
+}
+
+func TestConfig_MergeDefault_Disabled(t *testing.T) {
+	cfg := &Config{RetryCount: -1, CircuitBreakThreshold: -1}
+	assert.NoError(t, cfg.MergeDefault())
+	assert.Equal(t, -1, cfg.RetryCount)
+	assert.Equal(t, -1, cfg.CircuitBreakThreshold)
+
+	// 0 is not distinguished from the unset
+	cfg = &Config{}
+	assert.NoError(t, cfg.MergeDefault())
+	assert.Equal(t, DefaultConfig().RetryCount, cfg.RetryCount)
+	assert.Equal(t, DefaultConfig().CircuitBreakThreshold, cfg.CircuitBreakThreshold)
+}
@@ -0,0 +1,183 @@
+package cfgs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/jopbrown/gobase/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables which override the top
+// level fields of the config, e.g. GPTBOT_CHAT_GPT_ACCESS_TOKEN overrides
+// ChatGptAccessToken.
+const EnvPrefix = "GPTBOT_"
+
+var reExpandVar = regexp.MustCompile(`\$\{(env\.|file:)([^}]*)\}`)
+
+// expandNode expands ${env.VARNAME} to the environment variable and
+// ${file:/path} to the content of the file in the string values of the node.
+// The relative paths are relative to dir. The expanded plain values are
+// resolved again, so they can be numbers or durations, e.g. ServePort:
+// ${env.PORT}, while the quoted values stay strings.
+func expandNode(node *yaml.Node, dir string) error {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		value, err := expandString(node.Value, dir)
+		if err != nil {
+			return errors.Errorf("line %d: %v", node.Line, err)
+		}
+		if value != node.Value && node.Style == 0 {
+			node.Tag = ""
+		}
+		node.Value = value
+		return nil
+	}
+
+	for _, child := range node.Content {
+		err := expandNode(child, dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expandString(s string, dir string) (string, error) {
+	var err error
+	expanded := reExpandVar.ReplaceAllStringFunc(s, func(m string) string {
+		sub := reExpandVar.FindStringSubmatch(m)
+		kind, name := sub[1], strings.TrimSpace(sub[2])
+
+		if kind == "env." {
+			value, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = errors.Errorf("environment variable is not set: %s", name)
+			}
+			return value
+		}
+
+		fname := name
+		if !filepath.IsAbs(fname) && dir != "" {
+			fname = filepath.Join(dir, fname)
+		}
+		data, readErr := os.ReadFile(fname)
+		if readErr != nil && err == nil {
+			err = errors.Errorf("unable to read secret file: %s", fname)
+		}
+		// the secret files usually end with a newline
+		return strings.TrimRight(string(data), "\r\n")
+	})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+// decodeExpanded decodes the yaml with the variables expanded, it returns the
+// node to locate the settings.
+func decodeExpanded(dec *yaml.Decoder, v any, dir string) (*yaml.Node, error) {
+	node := &yaml.Node{}
+	err := dec.Decode(node)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	err = expandNode(node, dir)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	err = node.Decode(v)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	return node, nil
+}
+
+// ApplyEnv overrides the top level fields of the config by the environment
+// variables named EnvPrefix with the field name in upper snake case. The maps
+// like Bots and Roles can not be overridden.
+func (cfg *Config) ApplyEnv() error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("yaml")
+		value, ok := os.LookupEnv(EnvPrefix + toUpperSnake(name))
+		if !ok {
+			continue
+		}
+
+		node := &yaml.Node{}
+		switch field.Type.Kind() {
+		case reflect.Map, reflect.Pointer, reflect.Struct:
+			continue
+		case reflect.String:
+			// keep the value as is, e.g. tokens with colons
+			node.Kind = yaml.ScalarNode
+			node.Tag = "!!str"
+			node.Value = value
+		default:
+			err := yaml.Unmarshal([]byte(value), node)
+			if err != nil || len(node.Content) == 0 {
+				return errors.Errorf("invalid %s%s: %q", EnvPrefix, toUpperSnake(name), value)
+			}
+			node = node.Content[0]
+		}
+
+		err := node.Decode(v.Field(i).Addr().Interface())
+		if err != nil {
+			return errors.ErrorAtf(err, "invalid %s%s: %q", EnvPrefix, toUpperSnake(name), value)
+		}
+	}
+	return nil
+}
+
+// toUpperSnake converts the field name, e.g. ChatGptApiUrl to CHAT_GPT_API_URL
+// and CmdsTalkToAI to CMDS_TALK_TO_AI.
+func toUpperSnake(name string) string {
+	sb := &strings.Builder{}
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) && unicode.IsLower(rune(name[i-1])) {
+			sb.WriteByte('_')
+		}
+		sb.WriteRune(r)
+	}
+	return strings.ToUpper(sb.String())
+}
+
+// Masked returns a copy of the config whose secrets are masked, it is safe to
+// be written to the logs.
+func (cfg *Config) Masked() *Config {
+	data := errors.Must1(yaml.Marshal(cfg))
+	masked := &Config{}
+	errors.Must(yaml.Unmarshal(data, masked))
+
+	masked.ChatGptAccessToken = maskSecret(masked.ChatGptAccessToken)
+	masked.AdminToken = maskSecret(masked.AdminToken)
+	masked.AdminPassword = maskSecret(masked.AdminPassword)
+	for i, token := range masked.ApiTokens {
+		masked.ApiTokens[i] = maskSecret(token)
+	}
+	for _, p := range masked.Providers {
+		p.AccessToken = maskSecret(p.AccessToken)
+	}
+	for _, bot := range masked.Bots {
+		bot.LineChannelToken = maskSecret(bot.LineChannelToken)
+		bot.LineChannelSecret = maskSecret(bot.LineChannelSecret)
+		bot.TelegramToken = maskSecret(bot.TelegramToken)
+		bot.TelegramSecretToken = maskSecret(bot.TelegramSecretToken)
+	}
+	return masked
+}
+
+func maskSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "******"
+}
@@ -0,0 +1,51 @@
+package cfgs
+
+// Limit limits the chat messages sent to the models, the zero values are
+// unlimited. RatePerMinute refills a token bucket of Burst messages, Burst is
+// at least 1. The daily quotas are reset at midnight.
+type Limit struct {
+	RatePerMinute float64 `yaml:"RatePerMinute"`
+	Burst         int     `yaml:"Burst"`
+	DailyRequests int     `yaml:"DailyRequests"`
+	DailyTokens   int     `yaml:"DailyTokens"`
+}
+
+// RateLimits are the limits shared by everyone and the limits of each user
+// and group. IDs overrides PerUser or PerGroup for the user or group ID of the
+// chat platform.
+type RateLimits struct {
+	Global   *Limit            `yaml:"Global"`
+	PerUser  *Limit            `yaml:"PerUser"`
+	PerGroup *Limit            `yaml:"PerGroup"`
+	IDs      map[string]*Limit `yaml:"IDs"`
+}
+
+// UserLimit returns the limit of the user, nil if unlimited.
+func (limits *RateLimits) UserLimit(userID string) *Limit {
+	if limits == nil {
+		return nil
+	}
+	if limit, ok := limits.IDs[userID]; ok {
+		return limit
+	}
+	return limits.PerUser
+}
+
+// GroupLimit returns the limit of the group, nil if unlimited.
+func (limits *RateLimits) GroupLimit(groupID string) *Limit {
+	if limits == nil {
+		return nil
+	}
+	if limit, ok := limits.IDs[groupID]; ok {
+		return limit
+	}
+	return limits.PerGroup
+}
+
+// GlobalLimit returns the limit shared by everyone, nil if unlimited.
+func (limits *RateLimits) GlobalLimit() *Limit {
+	if limits == nil {
+		return nil
+	}
+	return limits.Global
+}
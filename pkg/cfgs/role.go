@@ -3,18 +3,43 @@ package cfgs
 import (
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/jopbrown/gobase/errors"
 	"github.com/jopbrown/gobase/fsutil"
 	"gopkg.in/yaml.v3"
 )
 
+// ToolDrawImage is the tool which draws images, it requires PublicUrl to serve
+// the images.
+const ToolDrawImage = "draw_image"
+
 type Role struct {
-	Prompt               string   `yaml:"Prompt"`
-	MaxConversationCount int      `yaml:"MaxConversationCount"`
-	PrefixUserName       bool     `yaml:"PrefixUserName"`
-	NotNeedSlashCmd      bool     `yaml:"NotNeedSlashCmd"`
-	CmdsTalkToAI         []string `yaml:"CmdsTalkToAI"`
+	Prompt               string      `yaml:"Prompt"`
+	Provider             string      `yaml:"Provider"`
+	Model                string      `yaml:"Model"`
+	Fallbacks            []*Fallback `yaml:"Fallbacks"`
+	Temperature          *float32    `yaml:"Temperature"`
+	TopP                 *float32    `yaml:"TopP"`
+	MaxTokens            int         `yaml:"MaxTokens"`
+	PresencePenalty      float32     `yaml:"PresencePenalty"`
+	FrequencyPenalty     float32     `yaml:"FrequencyPenalty"`
+	Stop                 []string    `yaml:"Stop"`
+	ResponseFormat       string      `yaml:"ResponseFormat"`
+	MaxConversationCount int         `yaml:"MaxConversationCount"`
+	PrefixUserName       bool        `yaml:"PrefixUserName"`
+	NotNeedSlashCmd      bool        `yaml:"NotNeedSlashCmd"`
+	CmdsTalkToAI         []string    `yaml:"CmdsTalkToAI"`
+	Stream               bool        `yaml:"Stream"`
+	StreamPushParagraph  bool        `yaml:"StreamPushParagraph"`
+	MaxContextTokens     int         `yaml:"MaxContextTokens"`
+	ReservedReplyTokens  int         `yaml:"ReservedReplyTokens"`
+	SummarizeThreshold   int         `yaml:"SummarizeThreshold"`
+	Tools                []string    `yaml:"Tools"`
+	VisionModel          string      `yaml:"VisionModel"`
+	TextToSpeech         bool        `yaml:"TextToSpeech"`
+	TtsVoice             string      `yaml:"TtsVoice"`
+	RateLimit            *Limit      `yaml:"RateLimit"`
 }
 
 type Roles map[string]*Role
@@ -26,29 +51,45 @@ func DefaultRoles() Roles {
 }
 
 func LoadRoles(fname string) (Roles, error) {
-	f, err := os.Open(fname)
+	roles, _, err := loadRoles(fname)
 	if err != nil {
 		return nil, errors.ErrorAt(err)
 	}
+	return roles, nil
+}
+
+func loadRoles(fname string) (Roles, *source, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, errors.ErrorAt(err)
+	}
 	defer f.Close()
 
-	roles, err := ReadRoles(f)
+	roles, node, err := readRoles(f, filepath.Dir(fname))
 	if err != nil {
-		return nil, errors.ErrorAt(err)
+		return nil, nil, errors.ErrorAtf(err, "invalid roles: %s", fname)
 	}
 
-	return roles, nil
+	return roles, &source{fname: fname, node: node, prefix: []string{"Roles"}}, nil
 }
 
 func ReadRoles(r io.Reader) (Roles, error) {
-	roles := Roles{}
-	err := yaml.NewDecoder(r).Decode(&roles)
+	roles, _, err := readRoles(r, "")
 	if err != nil {
 		return nil, errors.ErrorAt(err)
 	}
 	return roles, nil
 }
 
+func readRoles(r io.Reader, dir string) (Roles, *yaml.Node, error) {
+	roles := Roles{}
+	node, err := decodeExpanded(yaml.NewDecoder(r), &roles, dir)
+	if err != nil {
+		return nil, nil, errors.ErrorAt(err)
+	}
+	return roles, node, nil
+}
+
 func (roles Roles) SaveRoles(fname string) error {
 	f, err := fsutil.OpenFileWrite(fname)
 	if err != nil {
@@ -0,0 +1,332 @@
+package cfgs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SessionStoreMemory = "memory"
+	SessionStoreFile   = "file"
+)
+
+// the policies when the task queue is full
+const (
+	OverloadBusy       = "busy"
+	OverloadDropOldest = "drop_oldest"
+	OverloadCoalesce   = "coalesce"
+)
+
+// source is a loaded yaml file, it locates the settings for the validation
+// errors. The node of the file is at prefix in the config, e.g. the roles file
+// is at Roles.
+type source struct {
+	fname  string
+	node   *yaml.Node
+	prefix []string
+}
+
+// locate returns the file and line of the setting at path. If the setting is
+// not in the file, it returns the line of the nearest parent. The line is 0 if
+// the setting comes from the default config.
+func (cfg *Config) locate(path []string) (string, int) {
+	fname, line, depth := "", 0, 0
+	for _, src := range cfg.sources {
+		if len(path) < len(src.prefix) || strings.Join(path[:len(src.prefix)], "\x00") != strings.Join(src.prefix, "\x00") {
+			continue
+		}
+
+		node := src.node
+		if node.Kind == yaml.DocumentNode && len(node.Content) != 0 {
+			node = node.Content[0]
+		}
+		d := len(src.prefix)
+		for _, key := range path[len(src.prefix):] {
+			child := childNode(node, key)
+			if child == nil {
+				break
+			}
+			node = child
+			d++
+		}
+		if d > depth {
+			fname, line, depth = src.fname, node.Line, d
+		}
+	}
+	return fname, line
+}
+
+// childNode returns the value of the key in a mapping or the item at the index
+// in a sequence.
+func childNode(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind == yaml.SequenceNode {
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(node.Content) {
+			return nil
+		}
+		return node.Content[i]
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			// point at the key, the value of a mapping starts at the next line
+			if node.Content[i+1].Kind == yaml.MappingNode || node.Content[i+1].Kind == yaml.SequenceNode {
+				value := *node.Content[i+1]
+				value.Line = node.Content[i].Line
+				return &value
+			}
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Problem is an invalid setting found by Validate.
+type Problem struct {
+	File    string
+	Line    int
+	Path    string
+	Message string
+}
+
+func (p *Problem) String() string {
+	switch {
+	case p.File != "" && p.Line > 0:
+		return fmt.Sprintf("%s:%d: %s: %s", p.File, p.Line, p.Path, p.Message)
+	case p.Line > 0:
+		return fmt.Sprintf("line %d: %s: %s", p.Line, p.Path, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidationError lists every problem of the config.
+type ValidationError struct {
+	Problems []*Problem
+}
+
+func (e *ValidationError) Error() string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "invalid config, %d problem(s):", len(e.Problems))
+	for _, p := range e.Problems {
+		sb.WriteString("\n    ")
+		sb.WriteString(p.String())
+	}
+	return sb.String()
+}
+
+type validator struct {
+	cfg      *Config
+	problems []*Problem
+}
+
+func (v *validator) addf(path []string, format string, args ...any) {
+	fname, line := v.cfg.locate(path)
+	v.problems = append(v.problems, &Problem{
+		File:    fname,
+		Line:    line,
+		Path:    strings.Join(path, "."),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) checkProvider(path []string, name string) {
+	if _, ok := v.cfg.GetProvider(name); !ok {
+		v.addf(path, "provider %q is not defined in Providers", name)
+	}
+}
+
+// checkLimit checks the limit at path, nil is unlimited.
+func (v *validator) checkLimit(path []string, limit *Limit) {
+	if limit == nil {
+		return
+	}
+	if limit.RatePerMinute < 0 {
+		v.addf(append(path, "RatePerMinute"), "must not be negative, got %v", limit.RatePerMinute)
+	}
+	if limit.Burst < 0 {
+		v.addf(append(path, "Burst"), "must not be negative, got %d", limit.Burst)
+	}
+	if limit.DailyRequests < 0 {
+		v.addf(append(path, "DailyRequests"), "must not be negative, got %d", limit.DailyRequests)
+	}
+	if limit.DailyTokens < 0 {
+		v.addf(append(path, "DailyTokens"), "must not be negative, got %d", limit.DailyTokens)
+	}
+}
+
+// Validate checks the config merged with the default config, it returns a
+// *ValidationError with every problem found.
+func (cfg *Config) Validate() error {
+	v := &validator{cfg: cfg}
+
+	if cfg.ServePort <= 0 || cfg.ServePort > 65535 {
+		v.addf([]string{"ServePort"}, "must be between 1 and 65535, got %d", cfg.ServePort)
+	}
+	if cfg.SessionClearInterval <= 0 {
+		v.addf([]string{"SessionClearInterval"}, "must be positive, got %v", cfg.SessionClearInterval)
+	}
+	if cfg.SessionExpirePeriod <= 0 {
+		v.addf([]string{"SessionExpirePeriod"}, "must be positive, got %v", cfg.SessionExpirePeriod)
+	}
+	switch cfg.SessionStore {
+	case "", SessionStoreMemory, SessionStoreFile:
+	default:
+		v.addf([]string{"SessionStore"}, "must be %s or %s, got %q", SessionStoreMemory, SessionStoreFile, cfg.SessionStore)
+	}
+	if cfg.MaxTaskQueueCap < 0 {
+		v.addf([]string{"MaxTaskQueueCap"}, "must not be negative, got %d", cfg.MaxTaskQueueCap)
+	}
+	switch cfg.QueueOverloadPolicy {
+	case "", OverloadBusy, OverloadDropOldest, OverloadCoalesce:
+	default:
+		v.addf([]string{"QueueOverloadPolicy"}, "must be %s, %s or %s, got %q", OverloadBusy, OverloadDropOldest, OverloadCoalesce, cfg.QueueOverloadPolicy)
+	}
+	if cfg.TaskWorkerCount < 0 {
+		v.addf([]string{"TaskWorkerCount"}, "must not be negative, got %d", cfg.TaskWorkerCount)
+	}
+	if cfg.RetryCount < -1 {
+		v.addf([]string{"RetryCount"}, "must be -1 to disable or not negative, got %d", cfg.RetryCount)
+	}
+	if cfg.CircuitBreakThreshold < -1 {
+		v.addf([]string{"CircuitBreakThreshold"}, "must be -1 to disable or not negative, got %d", cfg.CircuitBreakThreshold)
+	}
+	if cfg.RequestTimeout < 0 {
+		v.addf([]string{"RequestTimeout"}, "must not be negative, got %v", cfg.RequestTimeout)
+	}
+	if cfg.ShutdownTimeout < 0 {
+		v.addf([]string{"ShutdownTimeout"}, "must not be negative, got %v", cfg.ShutdownTimeout)
+	}
+	if len(cfg.CmdsDrawImage) != 0 && cfg.PublicUrl == "" {
+		v.addf([]string{"CmdsDrawImage"}, "requires PublicUrl to serve the images")
+	}
+
+	for name, p := range cfg.Providers {
+		path := []string{"Providers", name}
+		switch p.GetType() {
+		case ProviderOpenAI, ProviderAnthropic, ProviderOllama:
+		case ProviderAzure:
+			if p.ApiUrl == "" {
+				v.addf(append(path, "ApiUrl"), "azure provider requires the endpoint")
+			}
+		default:
+			v.addf(append(path, "Type"), "unknown provider type %q", p.Type)
+		}
+	}
+	for i, fb := range cfg.Fallbacks {
+		v.checkProvider([]string{"Fallbacks", fmt.Sprint(i), "Provider"}, fb.Provider)
+	}
+
+	if len(cfg.ApiTokens) != 0 {
+		if _, ok := cfg.Roles[cfg.ApiDefaultRole]; !ok {
+			v.addf([]string{"ApiDefaultRole"}, "role %q is not defined in Roles", cfg.ApiDefaultRole)
+		}
+	}
+
+	if cfg.AdminUser != "" && cfg.AdminPassword == "" {
+		v.addf([]string{"AdminPassword"}, "is required by AdminUser")
+	}
+	if cfg.AdminUser == "" && cfg.AdminPassword != "" {
+		v.addf([]string{"AdminUser"}, "is required by AdminPassword")
+	}
+
+	if limits := cfg.RateLimits; limits != nil {
+		v.checkLimit([]string{"RateLimits", "Global"}, limits.Global)
+		v.checkLimit([]string{"RateLimits", "PerUser"}, limits.PerUser)
+		v.checkLimit([]string{"RateLimits", "PerGroup"}, limits.PerGroup)
+		for id, limit := range limits.IDs {
+			v.checkLimit([]string{"RateLimits", "IDs", id}, limit)
+		}
+	}
+
+	for botPath, bot := range cfg.Bots {
+		path := []string{"Bots", botPath}
+		if !strings.HasPrefix(botPath, "/") {
+			v.addf(path, "the path of the bot must start with /")
+		}
+		if botPath == "/v1" || strings.HasPrefix(botPath, "/v1/") {
+			v.addf(path, "the paths under /v1 are reserved for the chat API")
+		}
+		if botPath == "/admin" || strings.HasPrefix(botPath, "/admin/") {
+			v.addf(path, "the paths under /admin are reserved for the admin API")
+		}
+		if bot.DefaultRole == "" {
+			v.addf(append(path, "DefaultRole"), "is required")
+		} else if _, ok := cfg.Roles[bot.DefaultRole]; !ok {
+			v.addf(append(path, "DefaultRole"), "role %q is not defined in Roles", bot.DefaultRole)
+		}
+		if bot.Provider != "" {
+			v.checkProvider(append(path, "Provider"), bot.Provider)
+		}
+		v.checkLimit(append(path, "RateLimit"), bot.RateLimit)
+
+		switch bot.GetPlatform() {
+		case PlatformLine:
+			if bot.LineChannelToken == "" {
+				v.addf(append(path, "LineChannelToken"), "is required by LINE")
+			}
+			if bot.LineChannelSecret == "" {
+				v.addf(append(path, "LineChannelSecret"), "is required by LINE")
+			}
+		case PlatformTelegram:
+			if bot.TelegramToken == "" {
+				v.addf(append(path, "TelegramToken"), "is required by Telegram")
+			}
+			switch bot.TelegramMode {
+			case "", TelegramModeWebhook, TelegramModePoll:
+			default:
+				v.addf(append(path, "TelegramMode"), "must be %s or %s, got %q", TelegramModeWebhook, TelegramModePoll, bot.TelegramMode)
+			}
+		case PlatformTerminal:
+		default:
+			v.addf(append(path, "Platform"), "unknown platform %q", bot.Platform)
+		}
+	}
+
+	for name, role := range cfg.Roles {
+		path := []string{"Roles", name}
+		if role == nil {
+			v.addf(path, "is empty")
+			continue
+		}
+		if role.Provider != "" {
+			v.checkProvider(append(path, "Provider"), role.Provider)
+		}
+		for i, fb := range role.Fallbacks {
+			v.checkProvider(append(path, "Fallbacks", fmt.Sprint(i), "Provider"), fb.Provider)
+		}
+		switch role.ResponseFormat {
+		case "", "text", "json_object":
+		default:
+			v.addf(append(path, "ResponseFormat"), "must be text or json_object, got %q", role.ResponseFormat)
+		}
+		if role.TextToSpeech && cfg.PublicUrl == "" {
+			v.addf(append(path, "TextToSpeech"), "requires PublicUrl to serve the audio")
+		}
+		if slices.Contains(role.Tools, ToolDrawImage) && cfg.PublicUrl == "" {
+			v.addf(append(path, "Tools"), "%s requires PublicUrl to serve the images", ToolDrawImage)
+		}
+		v.checkLimit(append(path, "RateLimit"), role.RateLimit)
+	}
+
+	if len(v.problems) == 0 {
+		return nil
+	}
+	sort.Slice(v.problems, func(i, j int) bool {
+		a, b := v.problems[i], v.problems[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Path < b.Path
+	})
+	return &ValidationError{Problems: v.problems}
+}
@@ -0,0 +1,72 @@
+package cfgs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "gptbot.yaml")
+	os.WriteFile(fname, []byte(`SessionClearInterval: -1s
+RolesFile: roles.yaml
+Bots:
+    linebot:
+        DefaultRole: 不存在
+        LineChannelToken: token
+        LineChannelSecret: secret
+`), 0o600)
+	os.WriteFile(filepath.Join(dir, "roles.yaml"), []byte(`角色:
+    Prompt: hi
+    Fallbacks:
+        - Provider: azure
+`), 0o600)
+
+	cfg, err := Load(fname)
+	assert.NoError(t, err)
+
+	err = cfg.Validate()
+	verr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, []*Problem{
+		{File: fname, Line: 1, Path: "SessionClearInterval", Message: "must be positive, got -1s"},
+		{File: fname, Line: 4, Path: "Bots.linebot", Message: "the path of the bot must start with /"},
+		{File: fname, Line: 5, Path: "Bots.linebot.DefaultRole", Message: `role "不存在" is not defined in Roles`},
+		{File: filepath.Join(dir, "roles.yaml"), Line: 4, Path: "Roles.角色.Fallbacks.0.Provider", Message: `provider "azure" is not defined in Providers`},
+	}, verr.Problems)
+
+	cfg.SessionClearInterval = DefaultConfig().SessionClearInterval
+	cfg.Bots = map[string]*Bot{"/linebot": {DefaultRole: "角色", LineChannelToken: "token", LineChannelSecret: "secret"}}
+	cfg.Roles["角色"].Fallbacks = nil
+	assert.NoError(t, cfg.Validate())
+
+	// -1 disables the retries and the circuit breaker
+	cfg.RetryCount = -1
+	cfg.CircuitBreakThreshold = -1
+	assert.NoError(t, cfg.Validate())
+	cfg.RetryCount = -2
+	assert.Error(t, cfg.Validate())
+}
+
+func TestConfig_Validate_PublicUrl(t *testing.T) {
+	cfg := &Config{
+		Bots:          map[string]*Bot{"/terminal": {Platform: PlatformTerminal, DefaultRole: "畫家"}},
+		CmdsDrawImage: []string{"/draw"},
+		Roles:         Roles{"畫家": {Tools: []string{ToolDrawImage}}},
+	}
+	assert.NoError(t, cfg.MergeDefault())
+
+	err := cfg.Validate()
+	verr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, []*Problem{
+		{Path: "CmdsDrawImage", Message: "requires PublicUrl to serve the images"},
+		{Path: "Roles.畫家.Tools", Message: "draw_image requires PublicUrl to serve the images"},
+	}, verr.Problems)
+
+	cfg.PublicUrl = "https://example.com"
+	assert.NoError(t, cfg.Validate())
+}
@@ -0,0 +1,211 @@
+package chatbot
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jopbrown/gobase/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// registerAdminRoute serves the admin API if AdminToken or AdminUser is
+// configured. The session ids contain slashes, e.g. /linebot/U1234, so they
+// are the rest of the urls.
+func (bot *Bot) registerAdminRoute(handler *gin.Engine) {
+	cfg := bot.getConfig()
+	if cfg.AdminToken == "" && cfg.AdminUser == "" {
+		return
+	}
+
+	admin := handler.Group("/admin", bot.adminAuth)
+	admin.GET("/sessions", bot.adminListSessionsHandler)
+	admin.GET("/sessions/*id", bot.adminGetSessionHandler)
+	admin.PATCH("/sessions/*id", bot.adminUpdateSessionHandler)
+	admin.DELETE("/sessions/*id", bot.adminDeleteSessionHandler)
+	admin.GET("/queue", bot.adminQueueHandler)
+	admin.POST("/shutdown", bot.adminShutdownHandler)
+}
+
+func adminError(c *gin.Context, status int, msg string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": msg})
+}
+
+func secretEqual(s, secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(s), []byte(secret)) == 1
+}
+
+// adminAuth accepts the bearer token AdminToken, or the basic auth of
+// AdminUser and AdminPassword.
+func (bot *Bot) adminAuth(c *gin.Context) {
+	cfg := bot.getConfig()
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		if secretEqual(token, cfg.AdminToken) {
+			c.Next()
+			return
+		}
+	} else if user, password, ok := c.Request.BasicAuth(); ok {
+		if secretEqual(user, cfg.AdminUser) && secretEqual(password, cfg.AdminPassword) {
+			c.Next()
+			return
+		}
+	}
+
+	if cfg.AdminUser != "" {
+		c.Header("WWW-Authenticate", `Basic realm="gptbot admin"`)
+	}
+	log.Warnf("unauthorized admin request from %s: %s %s", c.ClientIP(), c.Request.Method, c.Request.URL.Path)
+	adminError(c, http.StatusUnauthorized, "unauthorized")
+}
+
+// adminSession returns the session of the url, or responds 404.
+func (bot *Bot) adminSession(c *gin.Context) (*Session, bool) {
+	id := c.Param("id")
+	session := bot.sessMgr.FindSession(id)
+	if session == nil {
+		adminError(c, http.StatusNotFound, "session not found: "+id)
+		return nil, false
+	}
+	return session, true
+}
+
+func (bot *Bot) adminListSessionsHandler(c *gin.Context) {
+	ids, err := bot.sessMgr.ListSessionIDs()
+	if err != nil {
+		adminError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	sessions := make([]gin.H, 0, len(ids))
+	for _, id := range ids {
+		session := bot.sessMgr.PeekSession(id)
+		if session == nil {
+			continue
+		}
+		sessions = append(sessions, gin.H{
+			"id":         session.ID,
+			"role":       session.Role,
+			"messages":   len(session.Messages),
+			"updated_at": session.LastUpdateDate.Format(time.RFC3339),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+func (bot *Bot) adminGetSessionHandler(c *gin.Context) {
+	session, ok := bot.adminSession(c)
+	if !ok {
+		return
+	}
+
+	session = session.Snapshot()
+	messages := make([]gin.H, 0, len(session.Messages))
+	for _, msg := range session.Messages {
+		m := gin.H{"role": msg.Role, "content": messageText(&msg)}
+		if msg.Role == openai.ChatMessageRoleTool {
+			m["tool_call_id"] = msg.ToolCallID
+		}
+		if len(msg.ToolCalls) != 0 {
+			m["tool_calls"] = msg.ToolCalls
+		}
+		messages = append(messages, m)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":         session.ID,
+		"role":       session.Role,
+		"updated_at": session.LastUpdateDate.Format(time.RFC3339),
+		"messages":   messages,
+	})
+}
+
+type adminUpdateSessionRequest struct {
+	// Role changes the role of the session, which also clears the messages.
+	Role string `json:"role"`
+	// Clear clears the messages of the session.
+	Clear bool `json:"clear"`
+}
+
+// adminUpdateSessionHandler changes the session in the task queue, so it does
+// not race with the tasks of the session.
+func (bot *Bot) adminUpdateSessionHandler(c *gin.Context) {
+	req := &adminUpdateSessionRequest{}
+	err := c.ShouldBindJSON(req)
+	if err != nil {
+		adminError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Role == "" && !req.Clear {
+		adminError(c, http.StatusBadRequest, "role or clear is required")
+		return
+	}
+	if _, ok := bot.getConfig().Roles[req.Role]; req.Role != "" && !ok {
+		adminError(c, http.StatusBadRequest, "role not found: "+req.Role)
+		return
+	}
+
+	session, ok := bot.adminSession(c)
+	if !ok {
+		return
+	}
+
+	var task Task = &ClearSessionTask{Session: session}
+	if req.Role != "" {
+		task = &ChangeRoleTask{Session: session, Role: req.Role}
+	}
+	err = bot.pushAndWait(task)
+	if err != nil {
+		adminError(c, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": session.ID, "role": session.GetRole(), "messages": session.Len()})
+}
+
+func (bot *Bot) adminDeleteSessionHandler(c *gin.Context) {
+	session, ok := bot.adminSession(c)
+	if !ok {
+		return
+	}
+
+	err := bot.pushAndWait(&deleteSessionTask{ID: session.ID})
+	if err != nil {
+		adminError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": session.ID, "deleted": true})
+}
+
+// deleteSessionTask deletes the session after the pending tasks of it.
+type deleteSessionTask struct {
+	ID string
+}
+
+func (task *deleteSessionTask) SessionID() string {
+	return task.ID
+}
+
+func (task *deleteSessionTask) Do(bot *Bot) error {
+	log.Infof("delete session %s ...", task.ID)
+	return bot.sessMgr.DeleteSession(task.ID)
+}
+
+func (bot *Bot) adminQueueHandler(c *gin.Context) {
+	cfg := bot.getConfig()
+	c.JSON(http.StatusOK, gin.H{
+		"queue":   bot.taskQueue.Stats(),
+		"workers": max(cfg.TaskWorkerCount, 1),
+		"policy":  cfg.QueueOverloadPolicy,
+	})
+}
+
+// adminShutdownHandler responds before stopping the bot, so the client knows
+// the request is accepted.
+func (bot *Bot) adminShutdownHandler(c *gin.Context) {
+	log.Infof("shutdown requested by %s", c.ClientIP())
+	c.JSON(http.StatusAccepted, gin.H{"message": "shutting down"})
+	c.Writer.Flush()
+	go bot.Stop()
+}
@@ -0,0 +1,88 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin(t *testing.T) {
+	cfg := newTestReloadConfig(t)
+	cfg.AdminToken = "token"
+	cfg.AdminUser = "admin"
+	cfg.AdminPassword = "password"
+	bot, err := NewBot(cfg)
+	assert.NoError(t, err)
+	go bot.DoTasks()
+
+	do := func(method, url, body string, auth func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		if auth != nil {
+			auth(r)
+		}
+		w := httptest.NewRecorder()
+		bot.ServeHTTP(w, r)
+		return w
+	}
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/stop", "", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/sessions", "", nil).Code)
+	w := do(http.MethodGet, "/admin/sessions", "", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+	w = do(http.MethodGet, "/admin/sessions", "", func(r *http.Request) { r.SetBasicAuth("admin", "password") })
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"sessions":[]}`, w.Body.String())
+
+	msg := &openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "hi"}
+	bot.sessMgr.GetSession("/linebot/U1", "A").AddMessage(msg)
+	bot.sessMgr.GetSession("/linebot/U2", "B").AddMessage(msg)
+	stored := NewSession("/linebot/U3", "A")
+	stored.AddMessage(msg)
+	assert.NoError(t, bot.sessMgr.Store.Save(stored))
+
+	w = do(http.MethodGet, "/admin/sessions", "", bearer)
+	list := struct{ Sessions []map[string]any }{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Sessions, 3)
+	assert.Equal(t, "/linebot/U1", list.Sessions[0]["id"])
+	assert.Equal(t, float64(1), list.Sessions[0]["messages"])
+	assert.Equal(t, "/linebot/U3", list.Sessions[2]["id"])
+	// listing does not load the stored sessions
+	assert.NotContains(t, bot.sessMgr.Sessions, "/linebot/U3")
+	assert.NoError(t, bot.sessMgr.Store.Delete("/linebot/U3"))
+
+	w = do(http.MethodGet, "/admin/sessions/linebot/U1", "", bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"messages":[{"content":"hi","role":"user"}]`)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/admin/sessions/linebot/U3", "", bearer).Code)
+
+	w = do(http.MethodPatch, "/admin/sessions/linebot/U1", `{"clear":true}`, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"/linebot/U1","role":"A","messages":0}`, w.Body.String())
+	w = do(http.MethodPatch, "/admin/sessions/linebot/U2", `{"role":"C"}`, bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do(http.MethodPatch, "/admin/sessions/linebot/U2", `{"role":"A"}`, bearer)
+	assert.JSONEq(t, `{"id":"/linebot/U2","role":"A","messages":0}`, w.Body.String())
+
+	assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/admin/sessions/linebot/U2", "", bearer).Code)
+	assert.Nil(t, bot.sessMgr.FindSession("/linebot/U2"))
+
+	w = do(http.MethodGet, "/admin/queue", "", bearer)
+	assert.JSONEq(t, `{"queue":{"waiting":0,"running":0,"capacity":1024,"sessions":{},"rejected":0,"dropped":0,"coalesced":0},"workers":4,"policy":"busy"}`, w.Body.String())
+
+	assert.Equal(t, http.StatusAccepted, do(http.MethodPost, "/admin/shutdown", "", bearer).Code)
+	select {
+	case <-bot.stop:
+	case <-time.After(time.Second):
+		t.Fatal("the bot is not stopped")
+	}
+	bot.Stop()
+}
@@ -0,0 +1,502 @@
+package chatbot
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// apiBotPath is the bot path of the sessions of the chat API, so the session
+// IDs are the same as the urls.
+const apiBotPath = "/v1/sessions"
+
+// apiCompletionPath is the bot path of the chat completions API, the callers
+// are limited by their API tokens like the users of the messengers.
+const apiCompletionPath = "/v1/chat/completions"
+
+var reApiSessionID = regexp.MustCompile(`^[\w@.\-]{1,128}$`)
+
+// registerApiRoute serves the chat API if ApiTokens is configured. The
+// requests are done in the task queue like the messages of the messengers.
+func (bot *Bot) registerApiRoute(handler *gin.Engine) {
+	if len(bot.getConfig().ApiTokens) == 0 {
+		return
+	}
+
+	api := handler.Group("/v1", bot.apiAuth)
+	api.GET("/models", bot.apiModelsHandler)
+	api.POST("/chat/completions", bot.apiChatCompletionsHandler)
+	api.GET("/sessions/:id", bot.apiGetSessionHandler)
+	api.DELETE("/sessions/:id", bot.apiClearSessionHandler)
+	api.POST("/sessions/:id/messages", bot.apiSessionMessageHandler)
+}
+
+func apiError(c *gin.Context, status int, errType, code, msg string) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"error": gin.H{
+			"message": msg,
+			"type":    errType,
+			"code":    code,
+		},
+	})
+}
+
+// apiUserKey is the context key of the user id of the authenticated token.
+const apiUserKey = "apiUser"
+
+// apiAuth accepts the bearer tokens in ApiTokens.
+func (bot *Bot) apiAuth(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if ok {
+		for _, t := range bot.getConfig().ApiTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				c.Set(apiUserKey, apiTokenUserID(token))
+				c.Next()
+				return
+			}
+		}
+	}
+	apiError(c, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "invalid bearer token")
+}
+
+// apiTokenUserID identifies the caller by the hash of the token for the rate
+// limits, since the user of the request is chosen by the caller. The hash keeps
+// the token out of the logs and the admin pages.
+func apiTokenUserID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:8])
+}
+
+// apiTaskError responds 503 if the task is not done because the bot is busy
+// or stopping, or 500 if the task fails.
+func apiTaskError(c *gin.Context, err error) {
+	if errors.Is(err, errTaskQueueFull) || errors.Is(err, errTaskDropped) || errors.Is(err, errBotStopping) {
+		c.Header("Retry-After", "1")
+		apiError(c, http.StatusServiceUnavailable, "server_error", "server_busy", err.Error())
+		return
+	}
+	apiError(c, http.StatusInternalServerError, "server_error", "", err.Error())
+}
+
+// waitTask closes done after the task is done, so the request can wait for it.
+type waitTask struct {
+	Task
+	done chan struct{}
+	err  error
+}
+
+func (task *waitTask) Do(bot *Bot) error {
+	defer close(task.done)
+	task.err = task.Task.Do(bot)
+	return task.err
+}
+
+// pushAndWait pushes the tasks and waits until the last one is done. The tasks
+// of the same session are done in order, so the others are done too.
+func (bot *Bot) pushAndWait(tasks ...Task) error {
+	last := &waitTask{Task: tasks[len(tasks)-1], done: make(chan struct{})}
+	tasks[len(tasks)-1] = last
+	err := bot.enqueue(tasks...)
+	if err != nil {
+		return err
+	}
+	<-last.done
+	return last.err
+}
+
+func (bot *Bot) apiModelsHandler(c *gin.Context) {
+	names := maps.Keys(bot.getConfig().Roles)
+	slices.Sort(names)
+
+	models := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		models = append(models, gin.H{"id": name, "object": "model", "owned_by": "gptbot"})
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": models})
+}
+
+var apiCompletionSeq atomic.Int64
+
+func (bot *Bot) apiChatCompletionsHandler(c *gin.Context) {
+	req := openai.ChatCompletionRequest{}
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+	if len(req.Messages) == 0 {
+		apiError(c, http.StatusBadRequest, "invalid_request_error", "", "messages is required")
+		return
+	}
+
+	// each completion is a session of its own, so they are done in parallel
+	task := &apiCompletionTask{
+		ID:     fmt.Sprintf("%s/%d", apiCompletionPath, apiCompletionSeq.Add(1)),
+		UserID: c.GetString(apiUserKey),
+		Req:    req,
+		c:      c,
+	}
+	err = bot.pushAndWait(task)
+	if err != nil && !c.Writer.Written() {
+		apiTaskError(c, err)
+	}
+}
+
+// apiCompletionTask answers the request of the chat completions API with the
+// role named by the model. It is stateless like the OpenAI API.
+type apiCompletionTask struct {
+	ID     string
+	UserID string
+	Req    openai.ChatCompletionRequest
+	c      *gin.Context
+}
+
+func (task *apiCompletionTask) SessionID() string {
+	return task.ID
+}
+
+func (task *apiCompletionTask) Do(bot *Bot) error {
+	cfg := bot.getConfig()
+	c := task.c
+	roleName := task.Req.Model
+	role, ok := cfg.Roles[roleName]
+	if !ok {
+		apiError(c, http.StatusNotFound, "invalid_request_error", "model_not_found", fmt.Sprintf("the model is not a role: %s", roleName))
+		return nil
+	}
+
+	scopes := bot.limitScopes(apiCompletionPath, task.UserID, "", roleName)
+	err := bot.limiter.Allow(scopes)
+	if err != nil {
+		apiLimitError(c, err)
+		return nil
+	}
+
+	chat := &ChatTask{}
+	chat.routes, _ = bot.chatRoutes("", role)
+	if len(chat.routes) == 0 {
+		apiError(c, http.StatusInternalServerError, "server_error", "", "the provider of the role is unavailable")
+		return nil
+	}
+
+	req := newApiRequest(task.Req, role)
+	ctx := c.Request.Context()
+	if cfg.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.RequestTimeout)
+		defer cancel()
+	}
+
+	if req.Stream {
+		return task.stream(bot, ctx, chat, req, scopes)
+	}
+
+	var resp openai.ChatCompletionResponse
+	err = chat.callWithFallback(ctx, bot, req, func(completer ChatCompleter, req openai.ChatCompletionRequest) error {
+		var err error
+		resp, err = completer.CreateChatCompletion(ctx, req)
+		return err
+	})
+	if err != nil {
+		apiProviderError(c, err)
+		return errors.ErrorAt(err)
+	}
+
+	tokens := resp.Usage.TotalTokens
+	if tokens == 0 && len(resp.Choices) != 0 {
+		tokens = NewTokenCounter(req.Model).CountTokens(append(req.Messages, resp.Choices[0].Message))
+	}
+	bot.limiter.AddTokens(scopes, tokens)
+
+	resp.Model = roleName
+	c.JSON(http.StatusOK, resp)
+	return nil
+}
+
+func (task *apiCompletionTask) stream(bot *Bot, ctx context.Context, chat *ChatTask, req openai.ChatCompletionRequest, scopes []*limitScope) error {
+	c := task.c
+	var stream ChatCompletionStream
+	err := chat.callWithFallback(ctx, bot, req, func(completer ChatCompleter, req openai.ChatCompletionRequest) error {
+		var err error
+		stream, err = completer.CreateChatCompletionStream(ctx, req)
+		return err
+	})
+	if err != nil {
+		apiProviderError(c, err)
+		return errors.ErrorAt(err)
+	}
+	defer stream.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	content := &strings.Builder{}
+	// estimated like the chat messages, since the streams do not report the usage
+	defer func() {
+		bot.limiter.AddTokens(scopes, NewTokenCounter(req.Model).CountTokens(append(req.Messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleAssistant,
+			Content: content.String(),
+		})))
+	}()
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			data, _ := json.Marshal(gin.H{"error": gin.H{"message": err.Error(), "type": "server_error"}})
+			fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+			c.Writer.Flush()
+			return errors.ErrorAt(err)
+		}
+
+		if len(resp.Choices) != 0 {
+			content.WriteString(resp.Choices[0].Delta.Content)
+		}
+		resp.Model = task.Req.Model
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return errors.ErrorAt(err)
+		}
+		fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+		c.Writer.Flush()
+	}
+	fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+	c.Writer.Flush()
+	return nil
+}
+
+// newApiRequest prepends the prompt of the role, and applies the parameters of
+// the role which are not given in the request.
+func newApiRequest(apiReq openai.ChatCompletionRequest, role *cfgs.Role) openai.ChatCompletionRequest {
+	req := openai.ChatCompletionRequest{}
+	applyRoleParams(&req, role)
+
+	// the primary route decides the model
+	req.Stream = apiReq.Stream
+	req.Tools = apiReq.Tools
+	req.ToolChoice = apiReq.ToolChoice
+	req.User = apiReq.User
+	if apiReq.Temperature != 0 {
+		req.Temperature = apiReq.Temperature
+	}
+	if apiReq.TopP != 0 {
+		req.TopP = apiReq.TopP
+	}
+	if apiReq.MaxTokens != 0 {
+		req.MaxTokens = apiReq.MaxTokens
+	}
+	if apiReq.PresencePenalty != 0 {
+		req.PresencePenalty = apiReq.PresencePenalty
+	}
+	if apiReq.FrequencyPenalty != 0 {
+		req.FrequencyPenalty = apiReq.FrequencyPenalty
+	}
+	if len(apiReq.Stop) != 0 {
+		req.Stop = apiReq.Stop
+	}
+	if apiReq.ResponseFormat != nil {
+		req.ResponseFormat = apiReq.ResponseFormat
+	}
+
+	req.Messages = make([]openai.ChatCompletionMessage, 0, len(apiReq.Messages)+1)
+	if role.Prompt != "" {
+		req.Messages = append(req.Messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: role.Prompt})
+	}
+	req.Messages = append(req.Messages, apiReq.Messages...)
+	return req
+}
+
+func apiProviderError(c *gin.Context, err error) {
+	status := GetOpenAIErrCode(err)
+	if status < http.StatusBadRequest {
+		status = http.StatusBadGateway
+	}
+	if apiErr, ok := errors.AsIs[*openai.APIError](err); ok {
+		apiError(c, status, apiErr.Type, "", apiErr.Message)
+		return
+	}
+	apiError(c, status, "server_error", "", err.Error())
+}
+
+// apiLimitError responds 429 like the OpenAI API when the limits are hit.
+func apiLimitError(c *gin.Context, err error) {
+	lerr, ok := errors.AsIs[*limitError](err)
+	if !ok {
+		apiError(c, http.StatusInternalServerError, "server_error", "", err.Error())
+		return
+	}
+	if lerr.wait != 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(lerr.wait.Seconds()))))
+	}
+	apiError(c, http.StatusTooManyRequests, "requests", "rate_limit_exceeded", lerr.Error())
+}
+
+type apiMessageRequest struct {
+	Message string `json:"message" binding:"required"`
+	User    string `json:"user"`
+}
+
+type apiReply struct {
+	Text      string   `json:"text,omitempty"`
+	ImageUrls []string `json:"image_urls,omitempty"`
+	AudioUrl  string   `json:"audio_url,omitempty"`
+}
+
+// apiCollector collects the replies of the tasks.
+type apiCollector struct {
+	mu      sync.Mutex
+	replies []*apiReply
+}
+
+func (col *apiCollector) channel() Channel {
+	return &funcChannel{reply: func(reply *Reply) error {
+		col.mu.Lock()
+		defer col.mu.Unlock()
+		r := &apiReply{Text: reply.Text, ImageUrls: reply.ImageUrls}
+		if reply.Audio != nil {
+			r.AudioUrl = reply.Audio.Url
+		}
+		col.replies = append(col.replies, r)
+		return nil
+	}}
+}
+
+func (col *apiCollector) get() []*apiReply {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	return col.replies
+}
+
+func apiSessionID(c *gin.Context) (string, bool) {
+	id := c.Param("id")
+	if !reApiSessionID.MatchString(id) || strings.Trim(id, ".") == "" {
+		apiError(c, http.StatusBadRequest, "invalid_request_error", "", "invalid session id")
+		return "", false
+	}
+	return id, true
+}
+
+// apiSessionMessageHandler sends the message to the session like a message of
+// the messengers, so the chat commands also work, e.g. /clear.
+func (bot *Bot) apiSessionMessageHandler(c *gin.Context) {
+	id, ok := apiSessionID(c)
+	if !ok {
+		return
+	}
+	req := &apiMessageRequest{}
+	err := c.ShouldBindJSON(req)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+
+	ev := &Event{
+		BotPath:        apiBotPath,
+		ConversationID: id,
+		UserID:         c.GetString(apiUserKey),
+		UserName:       req.User,
+		Mentioned:      true,
+		Text:           req.Message,
+	}
+	col := &apiCollector{}
+	tasks := bot.route(ev, col.channel())
+	if len(tasks) == 0 {
+		apiError(c, http.StatusBadRequest, "invalid_request_error", "", "message is empty")
+		return
+	}
+
+	err = bot.pushAndWait(tasks...)
+	if err != nil {
+		apiTaskError(c, err)
+		return
+	}
+
+	// the session may be deleted meanwhile, do not create it again
+	role := ""
+	session := bot.sessMgr.PeekSession(ev.SessionID())
+	if session != nil {
+		role = session.Role
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"session_id": id,
+		"role":       role,
+		"replies":    col.get(),
+	})
+}
+
+// apiSession returns the existing session of the url, or responds 404, so
+// reading or clearing does not create sessions.
+func (bot *Bot) apiSession(c *gin.Context) (string, *Session, bool) {
+	id, ok := apiSessionID(c)
+	if !ok {
+		return "", nil, false
+	}
+
+	session := bot.sessMgr.FindSession(apiBotPath + "/" + id)
+	if session == nil {
+		apiError(c, http.StatusNotFound, "invalid_request_error", "session_not_found", "session not found: "+id)
+		return "", nil, false
+	}
+	return id, session, true
+}
+
+func (bot *Bot) apiGetSessionHandler(c *gin.Context) {
+	id, session, ok := bot.apiSession(c)
+	if !ok {
+		return
+	}
+
+	session = session.Snapshot()
+	messages := make([]gin.H, 0, len(session.Messages))
+	for _, msg := range session.Messages {
+		if msg.Role == openai.ChatMessageRoleSystem || msg.Role == openai.ChatMessageRoleTool {
+			continue
+		}
+		text := messageText(&msg)
+		if text == "" {
+			continue
+		}
+		messages = append(messages, gin.H{"role": msg.Role, "content": text})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_id": id,
+		"role":       session.Role,
+		"updated_at": session.LastUpdateDate.Format(time.RFC3339),
+		"messages":   messages,
+	})
+}
+
+func (bot *Bot) apiClearSessionHandler(c *gin.Context) {
+	id, session, ok := bot.apiSession(c)
+	if !ok {
+		return
+	}
+
+	err := bot.pushAndWait(&ClearSessionTask{Session: session})
+	if err != nil {
+		apiTaskError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session_id": id, "cleared": true})
+}
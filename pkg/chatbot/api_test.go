@@ -0,0 +1,148 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestApiBot(t *testing.T) (*Bot, *[]openai.ChatCompletionRequest) {
+	reqs := make([]openai.ChatCompletionRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := openai.ChatCompletionRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		reqs = append(reqs, req)
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, token := range []string{"你", "好"} {
+				fmt.Fprintf(w, "data: {\"model\":\"%s\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"%s\"}}]}\n\n", req.Model, token)
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		fmt.Fprintf(w, `{"model":"%s","choices":[{"index":0,"message":{"role":"assistant","content":"你好"},"finish_reason":"stop"}]}`, req.Model)
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := newTestReloadConfig(t)
+	cfg.ChatGptApiUrl = server.URL
+	cfg.ApiTokens = []string{"secret"}
+	cfg.ApiDefaultRole = "A"
+	bot, err := NewBot(cfg)
+	assert.NoError(t, err)
+	go bot.DoTasks()
+	t.Cleanup(bot.Stop)
+	return bot, &reqs
+}
+
+func doApiRequest(bot *Bot, method, url, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	bot.ServeHTTP(w, r)
+	return w
+}
+
+func TestApi_ChatCompletions(t *testing.T) {
+	bot, reqs := newTestApiBot(t)
+
+	w := doApiRequest(bot, http.MethodGet, "/v1/models", "wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = doApiRequest(bot, http.MethodGet, "/v1/models", "secret", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"id":"A"`)
+
+	w = doApiRequest(bot, http.MethodPost, "/v1/chat/completions", "secret", `{"model":"C","messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doApiRequest(bot, http.MethodPost, "/v1/chat/completions", "secret", `{"model":"A","temperature":0.5,"messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := openai.ChatCompletionResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "A", resp.Model)
+	assert.Equal(t, "你好", resp.Choices[0].Message.Content)
+
+	req := (*reqs)[0]
+	assert.Equal(t, "gpt-3.5-turbo", req.Model)
+	assert.Equal(t, float32(0.5), req.Temperature)
+	assert.Equal(t, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "a"},
+		{Role: openai.ChatMessageRoleUser, Content: "hi"},
+	}, req.Messages)
+
+	w = doApiRequest(bot, http.MethodPost, "/v1/chat/completions", "secret", `{"model":"A","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `"model":"A"`)
+	assert.True(t, strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n"))
+}
+
+func TestApi_Sessions(t *testing.T) {
+	bot, reqs := newTestApiBot(t)
+
+	w := doApiRequest(bot, http.MethodPost, "/v1/sessions/../messages", "secret", `{"message":"hi"}`)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+
+	// reading or clearing does not create the session
+	w = doApiRequest(bot, http.MethodGet, "/v1/sessions/conv-0", "secret", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doApiRequest(bot, http.MethodDelete, "/v1/sessions/conv-0", "secret", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Nil(t, bot.sessMgr.FindSession("/v1/sessions/conv-0"))
+
+	w = doApiRequest(bot, http.MethodPost, "/v1/sessions/conv-1/messages", "secret", `{"message":"hi","user":"Alice"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"session_id":"conv-1","role":"A","replies":[{"text":"你好"}]}`, w.Body.String())
+
+	w = doApiRequest(bot, http.MethodPost, "/v1/sessions/conv-1/messages", "secret", `{"message":"again"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// the session keeps the conversation
+	assert.Len(t, (*reqs)[1].Messages, 4)
+
+	w = doApiRequest(bot, http.MethodGet, "/v1/sessions/conv-1", "secret", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	session := struct {
+		Role     string
+		Messages []map[string]string
+	}{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	assert.Equal(t, "A", session.Role)
+	assert.Len(t, session.Messages, 4)
+
+	w = doApiRequest(bot, http.MethodPost, "/v1/sessions/conv-1/messages", "secret", `{"message":"/cosplay B"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"role":"B"`)
+
+	w = doApiRequest(bot, http.MethodDelete, "/v1/sessions/conv-1", "secret", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, bot.sessMgr.GetSession("/v1/sessions/conv-1", "").Len())
+}
+
+func TestApi_Busy(t *testing.T) {
+	cfg := newTestReloadConfig(t)
+	cfg.ApiTokens = []string{"secret"}
+	cfg.ApiDefaultRole = "A"
+	cfg.MaxTaskQueueCap = 1
+	bot, err := NewBot(cfg)
+	assert.NoError(t, err)
+	// the tasks are not done, so the queue stays full
+	result, _ := bot.taskQueue.TryPush(bot, &testTask{id: "a"}, cfg.QueueOverloadPolicy)
+	assert.Equal(t, PushOK, result)
+
+	w := doApiRequest(bot, http.MethodPost, "/v1/chat/completions", "secret", `{"model":"A","messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"server_busy"`)
+
+	w = doApiRequest(bot, http.MethodPost, "/v1/sessions/conv-1/messages", "secret", `{"message":"hi"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,40 @@
+package chatbot
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// transcribeAudio downloads the audio and transcribes it through the
+// OpenAI-compatible audio transcription endpoint.
+func (bot *Bot) transcribeAudio(attachment *Attachment) (string, error) {
+	r, err := attachment.Open()
+	if err != nil {
+		return "", errors.ErrorAtf(err, "unable to download audio: %s", attachment.ID)
+	}
+	defer r.Close()
+
+	// the endpoint guesses the audio format by the file extension
+	name := attachment.Name
+	if path.Ext(name) == "" {
+		name = attachment.ID + ".m4a"
+	}
+
+	log.Debugf("transcribe audio %s ...", name)
+	resp, err := bot.audioClient.CreateTranscription(context.Background(), openai.AudioRequest{
+		Model:    bot.getConfig().TranscriptionModel,
+		FilePath: name,
+		Reader:   r,
+		Format:   openai.AudioResponseFormatJSON,
+	})
+	if err != nil {
+		return "", errors.ErrorAtf(err, "unable to transcribe audio: %s", attachment.ID)
+	}
+
+	return strings.TrimSpace(resp.Text), nil
+}
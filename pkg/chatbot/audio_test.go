@@ -0,0 +1,58 @@
+package chatbot
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatTask_voice(t *testing.T) {
+	var fileName string
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/audio/transcriptions":
+			_, header, err := r.FormFile("file")
+			assert.NoError(t, err)
+			fileName = header.Filename
+			assert.Equal(t, "whisper-1", r.FormValue("model"))
+			fmt.Fprint(w, `{"text":" 今天天氣如何 "}`)
+		case "/chat/completions":
+			fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"晴天"}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	bot.audioClient = bot.gptClient
+	bot.cfg.Store(&cfgs.Config{
+		ChatGptModel:       "gpt-3.5-turbo",
+		TranscriptionModel: "whisper-1",
+		LogPath:            t.TempDir(),
+		Roles:              cfgs.Roles{"test": &cfgs.Role{}},
+	})
+	bot.sessMgr = NewSessionManager(NewMemorySessionStore())
+
+	ch := &fakeChannel{}
+	task := &ChatTask{
+		UserName: "user",
+		Session:  NewSession("test", "test"),
+		Channel:  ch,
+		Audio: &Attachment{
+			Type: AttachmentAudio,
+			ID:   "12345",
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader("fake audio")), nil
+			},
+		},
+	}
+
+	assert.NoError(t, task.Do(bot))
+	assert.Equal(t, "12345.m4a", fileName)
+	assert.Equal(t, []*Reply{{Text: "🎤 今天天氣如何\n\n晴天", ImageUrls: []string{}}}, ch.replies)
+	assert.Equal(t, "今天天氣如何", task.Session.GetMessages()[0].Content)
+}
@@ -3,135 +3,254 @@ package chatbot
 import (
 	"fmt"
 	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jopbrown/gobase/errors"
 	"github.com/jopbrown/gobase/log"
 	"github.com/jopbrown/gptbot/pkg/cfgs"
-	"github.com/line/line-bot-sdk-go/v8/linebot"
 	"github.com/sashabaranov/go-openai"
 )
 
 type Bot struct {
-	cfg         *cfgs.Config
-	gptClient   *openai.Client
-	lineClients map[string]*linebot.Client
-
-	sessMgr       *SessionManager
-	taskQueue     chan Task
-	handler       *gin.Engine
-	stop          chan struct{}
-	userNameCache map[string]string
+	// mu guards the fields swapped by Reload against Dispatch and the
+	// background loops, the tasks are quiesced by pausing the task queue.
+	mu       sync.RWMutex
+	reloadMu sync.Mutex
+
+	// cfg is read without the lock by the tasks and the handlers, Reload
+	// swaps it atomically
+	cfg        atomic.Pointer[cfgs.Config]
+	gptClient  *openai.Client
+	providers  map[string]ChatCompleter
+	breaker    *circuitBreaker
+	messengers map[string]Messenger
+	tools      *ToolRegistry
+	limiter    *RateLimiter
+
+	// clients of the audio and image endpoints, they are gptClient unless
+	// their urls are configured, e.g. a local whisper server
+	audioClient *openai.Client
+	ttsClient   *openai.Client
+	imageClient *openai.Client
+	media       *MediaStore
+
+	sessMgr   *SessionManager
+	taskQueue *TaskQueue
+	handler   atomic.Pointer[gin.Engine]
+	stop      chan struct{}
+	stopOnce  sync.Once
+	drained   chan struct{}
+
+	// messengerStops stops the messengers removed or rebuilt by Reload
+	messengerStops map[string]chan struct{}
+	serving        bool
 }
 
 func NewBot(cfg *cfgs.Config) (*Bot, error) {
 	var err error
 	bot := &Bot{}
-	bot.cfg = cfg
-	bot.userNameCache = make(map[string]string)
+	bot.cfg.Store(cfg)
 
-	bot.lineClients = make(map[string]*linebot.Client, len(cfg.Bots))
-	for path, botcfg := range cfg.Bots {
-		client, err := linebot.New(botcfg.LineChannelSecret, botcfg.LineChannelToken)
-		if err != nil {
-			return nil, errors.ErrorAt(err)
-		}
-		bot.lineClients[path] = client
+	if !cfg.DebugMode {
+		gin.SetMode(gin.ReleaseMode)
+	}
 
-		botInfo, err := client.GetBotInfo().Do()
+	bot.messengers = make(map[string]Messenger, len(cfg.Bots))
+	for path, botcfg := range cfg.Bots {
+		messenger, err := newMessenger(bot, path, botcfg)
 		if err != nil {
 			return nil, errors.ErrorAt(err)
 		}
-		bot.userNameCache[path] = botInfo.DisplayName
+		bot.messengers[path] = messenger
 	}
+	bot.messengerStops = make(map[string]chan struct{}, len(cfg.Bots))
 
-	gptCfg := openai.DefaultConfig(cfg.ChatGptAccessToken)
-	gptCfg.BaseURL = cfg.ChatGptApiUrl
-	bot.gptClient = openai.NewClientWithConfig(gptCfg)
+	bot.gptClient = newGptClient(cfg, cfg.ChatGptApiUrl)
+	bot.providers, err = newChatCompleters(cfg)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	bot.breaker = newCircuitBreaker(cfg.CircuitBreakThreshold, cfg.CircuitBreakCooldown)
 
-	bot.sessMgr = NewSessionManager()
-	bot.taskQueue = make(chan Task, bot.cfg.MaxTaskQueueCap)
+	bot.audioClient = newGptClientIfUrl(cfg, bot.gptClient, cfg.TranscriptionApiUrl)
+	bot.ttsClient = newGptClientIfUrl(cfg, bot.gptClient, cfg.TtsApiUrl)
+	bot.imageClient = newGptClientIfUrl(cfg, bot.gptClient, cfg.ImageApiUrl)
+	bot.media = NewMediaStore(filepath.Join(cfg.LogPath, "media"))
 
-	bot.handler = gin.Default()
-	err = bot.registerRoute()
+	store, err := NewSessionStore(cfg)
 	if err != nil {
 		return nil, errors.ErrorAt(err)
 	}
+	bot.sessMgr = NewSessionManager(store)
+	bot.tools = DefaultToolRegistry()
+	bot.tools.Register(&drawImageTool{bot: bot})
+	bot.taskQueue = NewTaskQueue(bot.getConfig().MaxTaskQueueCap)
+	bot.limiter = NewRateLimiter()
 
+	bot.handler.Store(bot.newHandler(bot.messengers))
 	bot.stop = make(chan struct{})
+	bot.drained = make(chan struct{})
 
-	if !cfg.DebugMode {
-		gin.SetMode(gin.ReleaseMode)
+	return bot, nil
+}
+
+func newGptClient(cfg *cfgs.Config, url string) *openai.Client {
+	gptCfg := openai.DefaultConfig(cfg.ChatGptAccessToken)
+	gptCfg.BaseURL = url
+	return openai.NewClientWithConfig(gptCfg)
+}
+
+// newGptClientIfUrl returns a client of the url, or the chat client if the url
+// is empty.
+func newGptClientIfUrl(cfg *cfgs.Config, gptClient *openai.Client, url string) *openai.Client {
+	if url == "" {
+		return gptClient
 	}
+	return newGptClient(cfg, url)
+}
 
-	return bot, nil
+// ServeHTTP serves with the current handler, which is replaced by Reload when
+// the bots change.
+func (bot *Bot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bot.handler.Load().ServeHTTP(w, r)
 }
 
 func (bot *Bot) Serve() error {
-	addr := fmt.Sprintf(":%d", bot.cfg.ServePort)
-	server := &http.Server{Addr: addr, Handler: bot.handler}
+	addr := fmt.Sprintf(":%d", bot.getConfig().ServePort)
+	server := &http.Server{Addr: addr, Handler: bot}
 
 	go func() {
 		log.Infof("gptbot serve on %s", addr)
 		err := server.ListenAndServe()
-		if err != nil {
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Errorf("fail to ListenAndServe: %v", err)
 		}
 		bot.Stop()
 	}()
 
 	go bot.DoTasks()
+	bot.mu.Lock()
+	bot.serving = true
+	for path, messenger := range bot.messengers {
+		bot.runMessenger(path, messenger)
+	}
+	bot.mu.Unlock()
 	go bot.ClearExpiredSessionsPeriodically()
 
 	<-bot.stop
 	log.Info("gptbot stop serve")
+	bot.shutdown(server)
 
 	return nil
 }
 
+// DoTasks runs the workers until the bot stops, then drains the task queue.
 func (bot *Bot) DoTasks() {
+	defer close(bot.drained)
+
+	workerCount := max(bot.getConfig().TaskWorkerCount, 1)
+	var wg sync.WaitGroup
+	wg.Add(workerCount)
+	for i := 0; i < workerCount; i++ {
+		go func() {
+			defer wg.Done()
+			bot.doWorkerTasks()
+		}()
+	}
+
+	<-bot.stop
+	bot.drainTasks(&wg)
+}
+
+func (bot *Bot) doWorkerTasks() {
 	for {
-		select {
-		case task := <-bot.taskQueue:
-			err := task.Do(bot)
-			if err != nil {
-				log.ErrorAt(err)
-			}
-		case <-bot.stop:
+		task, ok := bot.taskQueue.Pop()
+		if !ok {
 			return
 		}
+
+		err := task.Do(bot)
+		if err != nil {
+			log.ErrorAt(err)
+		}
+		bot.taskQueue.Done(task)
 	}
 }
 
+// runMessenger runs the messenger until the bot stops or Reload removes it.
+// bot.mu must be locked.
+func (bot *Bot) runMessenger(path string, messenger Messenger) {
+	stop := make(chan struct{})
+	bot.messengerStops[path] = stop
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-bot.stop:
+		}
+		close(done)
+	}()
+	go messenger.Run(done)
+}
+
 func (bot *Bot) ClearExpiredSessionsPeriodically() {
-	ticker := time.NewTicker(bot.cfg.SessionClearInterval)
+	ticker := time.NewTicker(bot.getConfig().SessionClearInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			ids := bot.sessMgr.ClearExpiredSessions(bot.cfg.SessionExpirePeriod)
-			if len(ids) != 0 {
-				log.Infof("clear expired sessions: %v", ids)
-			}
+			bot.clearExpired()
 		case <-bot.stop:
 			return
 		}
 	}
 }
 
+func (bot *Bot) clearExpired() {
+	bot.mu.RLock()
+	defer bot.mu.RUnlock()
+
+	ids := bot.sessMgr.ClearExpiredSessions(bot.getConfig().SessionExpirePeriod)
+	if len(ids) != 0 {
+		log.Infof("clear expired sessions: %v", ids)
+	}
+	names, err := bot.media.ClearExpired(bot.getConfig().MediaExpirePeriod)
+	if err != nil {
+		log.ErrorAt(err)
+	}
+	if len(names) != 0 {
+		log.Infof("clear expired media: %v", names)
+	}
+	bot.limiter.ClearExpired()
+}
+
+// Stop stops the bot, it can be called more than once.
 func (bot *Bot) Stop() {
-	close(bot.stop)
+	bot.stopOnce.Do(func() {
+		close(bot.stop)
+	})
 }
 
-func (bot *Bot) registerRoute() error {
-	bot.handler.GET("/ping", bot.pingHandler)
-	bot.handler.GET("/stop", bot.stopHandler)
-	for key := range bot.cfg.Bots {
-		bot.handler.POST(key, bot.linebotCallback)
+// newHandler returns the engine with the routes of the messengers. gin can not
+// remove routes, so Reload builds a new engine when the bots change.
+func (bot *Bot) newHandler(messengers map[string]Messenger) *gin.Engine {
+	handler := gin.Default()
+	handler.GET("/ping", bot.pingHandler)
+	handler.GET("/media/:name", bot.mediaHandler)
+	for key, messenger := range messengers {
+		if h := messenger.Handler(); h != nil {
+			handler.POST(key, h)
+		}
 	}
-	return nil
+	bot.registerApiRoute(handler)
+	bot.registerAdminRoute(handler)
+	return handler
 }
 
 func (bot *Bot) pingHandler(c *gin.Context) {
@@ -139,12 +258,3 @@ func (bot *Bot) pingHandler(c *gin.Context) {
 		"message": "pong",
 	})
 }
-
-func (bot *Bot) stopHandler(c *gin.Context) {
-	c.JSON(200, gin.H{
-		"message": "stop service after 5s",
-	})
-	log.Info("stop service after 5s")
-	time.Sleep(5 * time.Second)
-	bot.Stop()
-}
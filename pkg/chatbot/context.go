@@ -0,0 +1,168 @@
+package chatbot
+
+import (
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+)
+
+// TokenCounter estimates how many tokens the messages take in the prompt.
+type TokenCounter interface {
+	CountTokens(msgs []openai.ChatCompletionMessage) int
+}
+
+// estimateTokenCounter estimates tokens by characters without loading the
+// tokenizer of the model. CJK characters are counted one by one, other text is
+// counted by the average characters per token. It tends to over count.
+type estimateTokenCounter struct {
+	tokensPerMessage float64
+	tokensPerCJK     float64
+	charsPerToken    float64
+}
+
+// tokensPerImage is the cost of a high detail 1024x1024 image.
+const tokensPerImage = 765
+
+func NewTokenCounter(model string) TokenCounter {
+	switch {
+	case strings.HasPrefix(model, "gpt-4o"), strings.HasPrefix(model, "o1"):
+		return &estimateTokenCounter{tokensPerMessage: 3, tokensPerCJK: 1, charsPerToken: 4}
+	case strings.HasPrefix(model, "gpt-4"), strings.HasPrefix(model, "gpt-3.5"):
+		return &estimateTokenCounter{tokensPerMessage: 3, tokensPerCJK: 1.5, charsPerToken: 4}
+	}
+
+	return &estimateTokenCounter{tokensPerMessage: 4, tokensPerCJK: 1.5, charsPerToken: 3.5}
+}
+
+func (counter *estimateTokenCounter) CountTokens(msgs []openai.ChatCompletionMessage) int {
+	// every reply is primed with <|start|>assistant<|message|>
+	tokens := 3.0
+	for _, msg := range msgs {
+		tokens += counter.tokensPerMessage
+		tokens += counter.countText(msg.Role)
+		tokens += counter.countText(msg.Name)
+		tokens += counter.countText(msg.Content)
+		for _, part := range msg.MultiContent {
+			tokens += counter.countText(part.Text)
+			if part.Type == openai.ChatMessagePartTypeImageURL {
+				tokens += tokensPerImage
+			}
+		}
+		for _, call := range msg.ToolCalls {
+			tokens += counter.countText(call.Function.Name)
+			tokens += counter.countText(call.Function.Arguments)
+		}
+	}
+	return int(math.Ceil(tokens))
+}
+
+func (counter *estimateTokenCounter) countText(text string) float64 {
+	cjk := 0
+	others := 0
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			cjk++
+		} else {
+			others++
+		}
+	}
+	return float64(cjk)*counter.tokensPerCJK + math.Ceil(float64(others)/counter.charsPerToken)
+}
+
+// ModelContextWindow returns the context window size of the model, it returns a
+// small window for unknown models.
+func ModelContextWindow(model string) int {
+	switch {
+	case strings.HasPrefix(model, "gpt-4o"), strings.HasPrefix(model, "gpt-4-turbo"), strings.HasPrefix(model, "o1"):
+		return 128000
+	case strings.HasPrefix(model, "gpt-4-32k"):
+		return 32768
+	case strings.HasPrefix(model, "gpt-4"):
+		return 8192
+	case strings.HasPrefix(model, "gpt-3.5-turbo-instruct"):
+		return 4096
+	case strings.HasPrefix(model, "gpt-3.5-turbo"):
+		return 16385
+	case strings.HasPrefix(model, "claude"):
+		return 200000
+	}
+
+	return 4096
+}
+
+// defaultReservedReplyTokens is reserved for the reply when the role sets
+// neither ReservedReplyTokens nor MaxTokens.
+const defaultReservedReplyTokens = 1024
+
+// contextTokenBudget returns the max tokens of the messages sent to the model.
+func contextTokenBudget(role *cfgs.Role, model string) int {
+	maxTokens := role.MaxContextTokens
+	if maxTokens <= 0 {
+		maxTokens = ModelContextWindow(model)
+	}
+	reserved := role.ReservedReplyTokens
+	if reserved <= 0 {
+		reserved = role.MaxTokens
+	}
+	if reserved <= 0 {
+		// at most a quarter of the small windows
+		reserved = min(defaultReservedReplyTokens, maxTokens/4)
+	}
+	return maxTokens - reserved
+}
+
+// trimMessages drops the oldest conversation turns until there are at most
+// maxTurns turns and the messages fit in maxTokens. A turn starts with a user
+// message. The leading system messages and the last turn are always kept.
+func trimMessages(msgs []openai.ChatCompletionMessage, maxTurns int, maxTokens int, counter TokenCounter) []openai.ChatCompletionMessage {
+	trimmed, _ := trimTurns(msgs, maxTurns, maxTokens, counter)
+	return trimmed
+}
+
+// splitTurns returns the count of the leading system messages and the start
+// index of each turn.
+func splitTurns(msgs []openai.ChatCompletionMessage) (int, []int) {
+	pinned := 0
+	for pinned < len(msgs) && msgs[pinned].Role == openai.ChatMessageRoleSystem {
+		pinned++
+	}
+
+	turnStarts := make([]int, 0)
+	for i := pinned; i < len(msgs); i++ {
+		if msgs[i].Role == openai.ChatMessageRoleUser && (i == pinned || msgs[i-1].Role != openai.ChatMessageRoleUser) {
+			turnStarts = append(turnStarts, i)
+		}
+	}
+
+	return pinned, turnStarts
+}
+
+// trimTurns is trimMessages but also returns the count of the dropped turns.
+func trimTurns(msgs []openai.ChatCompletionMessage, maxTurns int, maxTokens int, counter TokenCounter) ([]openai.ChatCompletionMessage, int) {
+	pinned, turnStarts := splitTurns(msgs)
+
+	drop := 0
+	if maxTurns > 0 && len(turnStarts) > maxTurns {
+		drop = len(turnStarts) - maxTurns
+	}
+
+	build := func(drop int) []openai.ChatCompletionMessage {
+		if drop == 0 {
+			return msgs
+		}
+		trimmed := make([]openai.ChatCompletionMessage, 0, len(msgs))
+		trimmed = append(trimmed, msgs[:pinned]...)
+		return append(trimmed, msgs[turnStarts[drop]:]...)
+	}
+
+	trimmed := build(drop)
+	for maxTokens > 0 && drop < len(turnStarts)-1 && counter.CountTokens(trimmed) > maxTokens {
+		drop++
+		trimmed = build(drop)
+	}
+
+	return trimmed, drop
+}
@@ -0,0 +1,50 @@
+package chatbot
+
+import (
+	"testing"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMessages(contents ...string) []openai.ChatCompletionMessage {
+	msgs := make([]openai.ChatCompletionMessage, 0, len(contents)+1)
+	msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: "prompt"})
+	for i, content := range contents {
+		role := openai.ChatMessageRoleUser
+		if i%2 == 1 {
+			role = openai.ChatMessageRoleAssistant
+		}
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: role, Content: content})
+	}
+	return msgs
+}
+
+func Test_trimMessages(t *testing.T) {
+	counter := NewTokenCounter("gpt-3.5-turbo")
+	msgs := newTestMessages("q1", "a1", "q2", "a2", "q3")
+
+	assert.Equal(t, msgs, trimMessages(msgs, 0, 0, counter))
+	assert.Equal(t, newTestMessages("q2", "a2", "q3"), trimMessages(msgs, 2, 0, counter))
+
+	budget := counter.CountTokens(newTestMessages("q3"))
+	assert.Equal(t, newTestMessages("q3"), trimMessages(msgs, 0, budget, counter))
+
+	// the system prompt and the last turn are kept even if they are too long
+	assert.Equal(t, newTestMessages("q3"), trimMessages(msgs, 0, 1, counter))
+}
+
+func TestTokenCounter(t *testing.T) {
+	counter := NewTokenCounter("gpt-3.5-turbo")
+	short := counter.CountTokens([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hello"}})
+	long := counter.CountTokens([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "你好，今天天氣很好"}})
+	assert.Greater(t, long, short)
+}
+
+func Test_contextTokenBudget(t *testing.T) {
+	assert.Equal(t, 4096-1024, contextTokenBudget(&cfgs.Role{}, "gpt-3.5-turbo-instruct"))
+	assert.Equal(t, 2000-500, contextTokenBudget(&cfgs.Role{MaxContextTokens: 2000}, "gpt-4o"))
+	assert.Equal(t, 8192-300, contextTokenBudget(&cfgs.Role{MaxTokens: 300}, "gpt-4"))
+	assert.Equal(t, 8192-200, contextTokenBudget(&cfgs.Role{MaxTokens: 300, ReservedReplyTokens: 200}, "gpt-4"))
+}
@@ -0,0 +1,218 @@
+package chatbot
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+)
+
+const maxRetryBackoff = 30 * time.Second
+
+// chatRoutes returns the route of the role followed by its fallbacks. The
+// fallbacks of the role override the global ones.
+func (bot *Bot) chatRoutes(botPath string, role *cfgs.Role) ([]*chatRoute, error) {
+	route, err := bot.chatRoute(botPath, role)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	fallbacks := bot.getConfig().Fallbacks
+	if len(role.Fallbacks) != 0 {
+		fallbacks = role.Fallbacks
+	}
+
+	routes := make([]*chatRoute, 0, 1+len(fallbacks))
+	routes = append(routes, route)
+	for _, fb := range fallbacks {
+		route, err := bot.newChatRoute(fb.Provider, fb.Model)
+		if err != nil {
+			return nil, errors.ErrorAt(err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// getChatRoutes returns the routes chosen for the task, or the default provider
+// with the model of the request.
+func (task *ChatTask) getChatRoutes(bot *Bot) []*chatRoute {
+	if len(task.routes) != 0 {
+		return task.routes
+	}
+	return []*chatRoute{{provider: cfgs.DefaultProvider, completer: bot.providers[cfgs.DefaultProvider]}}
+}
+
+// callWithFallback calls fn through the routes in order until one succeeds.
+// Each route is retried with exponential backoff on transient errors unless
+// RetryCount is -1. The backoff is interrupted when ctx is done. When there are
+// fallbacks, the models whose circuit is open are skipped. The primary route
+// keeps the model of the request, since it may be the vision model.
+func (task *ChatTask) callWithFallback(ctx context.Context, bot *Bot, req openai.ChatCompletionRequest, fn func(completer ChatCompleter, req openai.ChatCompletionRequest) error) error {
+	cfg := bot.getConfig()
+	routes := task.getChatRoutes(bot)
+	useBreaker := len(routes) > 1
+
+	var lastErr error
+	for i, route := range routes {
+		r := req
+		if i > 0 || r.Model == "" {
+			r.Model = route.model
+		}
+		// the models of a provider fail on their own, e.g. by rate limits
+		name := route.provider + "/" + r.Model
+
+		if useBreaker && !bot.breaker.Allow(name) {
+			log.Warnf("skip %s, its circuit is open", name)
+			continue
+		}
+
+		backoff := cfg.RetryBackoff
+		for attempt := 0; ; attempt++ {
+			lastErr = fn(route.completer, r)
+			if lastErr == nil {
+				bot.breaker.Success(name)
+				task.usedModel = name
+				return nil
+			}
+			if !isRetryableError(lastErr) || attempt >= cfg.RetryCount {
+				break
+			}
+
+			log.Warnf("retry %s after %v: %v", name, backoff, lastErr)
+			err := sleepContext(ctx, backoff)
+			if err != nil {
+				return errors.ErrorAt(err)
+			}
+			backoff = min(backoff*2, maxRetryBackoff)
+		}
+
+		// the request is canceled or timed out, it is not the fault of the endpoint
+		if ctx.Err() != nil {
+			return lastErr
+		}
+		if !isEndpointError(lastErr) {
+			return lastErr
+		}
+		bot.breaker.Failure(name)
+		if i < len(routes)-1 {
+			log.Warnf("%s failed, try the next fallback: %v", name, lastErr)
+		}
+	}
+
+	if lastErr == nil {
+		return newProviderError(http.StatusServiceUnavailable, "circuit_open", "all providers are unavailable, please try again later")
+	}
+	return lastErr
+}
+
+// sleepContext waits for d, it returns the error of ctx if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isRetryableError reports whether the error is transient, e.g. rate limits,
+// server errors and timeouts.
+func isRetryableError(err error) bool {
+	switch GetOpenAIErrCode(err) {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if _, ok := errors.AsIs[net.Error](err); ok {
+		return true
+	}
+	return false
+}
+
+// isEndpointError reports whether the error is caused by the endpoint rather
+// than the request, so another endpoint may work. 404 is not counted, since it
+// is usually a wrong model or url in the config rather than an outage.
+func isEndpointError(err error) bool {
+	if isRetryableError(err) {
+		return true
+	}
+
+	switch GetOpenAIErrCode(err) {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	}
+	return false
+}
+
+// circuitBreaker counts the consecutive failures of each model of the
+// providers, named provider/model. When the failures reach the threshold, the
+// circuit opens and the model is skipped until the cool-down passes. A nil
+// breaker or a threshold of -1 allows everything.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  map[string]int
+	openUntil map[string]time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{}
+	b.threshold = threshold
+	b.cooldown = cooldown
+	b.failures = make(map[string]int)
+	b.openUntil = make(map[string]time.Time)
+	return b
+}
+
+// Allow reports whether the model can be called. After the cool-down, the
+// model is allowed again, and one more failure opens the circuit again.
+func (b *circuitBreaker) Allow(name string) bool {
+	if b == nil || b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.openUntil[name])
+}
+
+func (b *circuitBreaker) Success(name string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, name)
+	delete(b.openUntil, name)
+}
+
+func (b *circuitBreaker) Failure(name string) {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures[name]++
+	if b.failures[name] >= b.threshold {
+		log.Warnf("open the circuit of %s for %v", name, b.cooldown)
+		b.openUntil[name] = time.Now().Add(b.cooldown)
+		b.failures[name] = b.threshold - 1
+	}
+}
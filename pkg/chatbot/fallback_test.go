@@ -0,0 +1,212 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatTask_callWithFallback(t *testing.T) {
+	primaryCalls, fallbackCalls := 0, 0
+	primaryStatus := http.StatusTooManyRequests
+	primary := newTestProviderServer(t, func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls++
+		w.WriteHeader(primaryStatus)
+		fmt.Fprint(w, `{"error":{"message":"failed"}}`)
+	})
+	fallback := newTestProviderServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fallbackCalls++
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"備援"}}]}`)
+	})
+
+	cfg := &cfgs.Config{
+		ChatGptApiUrl: primary,
+		ChatGptModel:  "gpt-4o",
+		Providers: map[string]*cfgs.Provider{
+			"backup": {ApiUrl: fallback, Model: "gpt-4o-mini"},
+		},
+		Fallbacks:    []*cfgs.Fallback{{Provider: "backup"}},
+		RetryCount:   1,
+		RetryBackoff: time.Millisecond,
+	}
+	providers, err := newChatCompleters(cfg)
+	assert.NoError(t, err)
+	bot := &Bot{providers: providers, breaker: newCircuitBreaker(2, time.Minute)}
+	bot.cfg.Store(cfg)
+
+	newTask := func() *ChatTask {
+		task := &ChatTask{Session: NewSession("test", "test")}
+		task.routes, err = bot.chatRoutes("/linebot", &cfgs.Role{})
+		assert.NoError(t, err)
+		return task
+	}
+	req := openai.ChatCompletionRequest{Model: "gpt-4o", Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}}
+
+	task := newTask()
+	content, err := task.createChatCompletion(bot, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "備援", content)
+	assert.Equal(t, "backup/gpt-4o-mini", task.usedModel)
+	assert.Equal(t, 2, primaryCalls)
+	assert.Equal(t, 1, fallbackCalls)
+
+	// the second failure opens the circuit of the primary
+	_, err = newTask().createChatCompletion(bot, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, primaryCalls)
+	_, err = newTask().createChatCompletion(bot, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, primaryCalls)
+	assert.Equal(t, 3, fallbackCalls)
+
+	// the bad request fails on every endpoint, so it does not fall back
+	bot.breaker = newCircuitBreaker(2, time.Minute)
+	primaryStatus = http.StatusBadRequest
+	_, err = newTask().createChatCompletion(bot, req)
+	assert.Equal(t, http.StatusBadRequest, GetOpenAIErrCode(err))
+	assert.Equal(t, 5, primaryCalls)
+	assert.Equal(t, 3, fallbackCalls)
+
+	// the wrong model or url does not fall back or open the circuit
+	primaryStatus = http.StatusNotFound
+	_, err = newTask().createChatCompletion(bot, req)
+	assert.Equal(t, http.StatusNotFound, GetOpenAIErrCode(err))
+	assert.Equal(t, 6, primaryCalls)
+	assert.Equal(t, 3, fallbackCalls)
+	assert.Empty(t, bot.breaker.failures)
+}
+
+func TestChatTask_callWithFallback_Models(t *testing.T) {
+	calls := map[string]int{}
+	server := newTestProviderServer(t, func(w http.ResponseWriter, r *http.Request) {
+		req := openai.ChatCompletionRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		calls[req.Model]++
+		if req.Model == "gpt-4o" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"rate limited"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"備援"}}]}`)
+	})
+
+	cfg := &cfgs.Config{
+		ChatGptApiUrl: server,
+		ChatGptModel:  "gpt-4o",
+		Fallbacks:     []*cfgs.Fallback{{Model: "gpt-4o-mini"}},
+	}
+	providers, err := newChatCompleters(cfg)
+	assert.NoError(t, err)
+	bot := &Bot{providers: providers, breaker: newCircuitBreaker(1, time.Minute)}
+	bot.cfg.Store(cfg)
+	req := openai.ChatCompletionRequest{Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}}
+
+	// the circuit of the primary model does not skip the other models of the provider
+	for i := 0; i < 2; i++ {
+		task := &ChatTask{Session: NewSession("test", "test")}
+		task.routes, err = bot.chatRoutes("/linebot", &cfgs.Role{})
+		assert.NoError(t, err)
+		_, err = task.createChatCompletion(bot, req)
+		assert.NoError(t, err)
+		assert.Equal(t, cfgs.DefaultProvider+"/gpt-4o-mini", task.usedModel)
+	}
+	assert.Equal(t, map[string]int{"gpt-4o": 1, "gpt-4o-mini": 2}, calls)
+	assert.False(t, bot.breaker.Allow(cfgs.DefaultProvider+"/gpt-4o"))
+}
+
+func TestChatTask_callWithFallback_Disabled(t *testing.T) {
+	primaryCalls, fallbackCalls := 0, 0
+	primary := newTestProviderServer(t, func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"error":{"message":"overloaded"}}`)
+	})
+	fallback := newTestProviderServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fallbackCalls++
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"備援"}}]}`)
+	})
+
+	cfg := &cfgs.Config{
+		ChatGptApiUrl: primary,
+		ChatGptModel:  "gpt-4o",
+		Providers: map[string]*cfgs.Provider{
+			"backup": {ApiUrl: fallback, Model: "gpt-4o-mini"},
+		},
+		Fallbacks:             []*cfgs.Fallback{{Provider: "backup"}},
+		RetryCount:            -1,
+		RetryBackoff:          time.Millisecond,
+		CircuitBreakThreshold: -1,
+	}
+	assert.NoError(t, cfg.MergeDefault())
+	providers, err := newChatCompleters(cfg)
+	assert.NoError(t, err)
+	bot := &Bot{providers: providers, breaker: newCircuitBreaker(cfg.CircuitBreakThreshold, cfg.CircuitBreakCooldown)}
+	bot.cfg.Store(cfg)
+	req := openai.ChatCompletionRequest{Model: "gpt-4o", Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}}
+
+	// no retry, and the primary is never skipped
+	for i := 0; i < 5; i++ {
+		task := &ChatTask{Session: NewSession("test", "test")}
+		task.routes, err = bot.chatRoutes("/linebot", &cfgs.Role{})
+		assert.NoError(t, err)
+		_, err = task.createChatCompletion(bot, req)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 5, primaryCalls)
+	assert.Equal(t, 5, fallbackCalls)
+}
+
+func TestChatTask_callWithFallback_Canceled(t *testing.T) {
+	calls := 0
+	server := newTestProviderServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"error":{"message":"overloaded"}}`)
+	})
+
+	cfg := &cfgs.Config{ChatGptApiUrl: server, ChatGptModel: "gpt-4o", RetryCount: 3, RetryBackoff: time.Hour}
+	providers, err := newChatCompleters(cfg)
+	assert.NoError(t, err)
+	bot := &Bot{providers: providers}
+	bot.cfg.Store(cfg)
+	task := &ChatTask{Session: NewSession("test", "test")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = task.callWithFallback(ctx, bot, openai.ChatCompletionRequest{Model: "gpt-4o"}, func(completer ChatCompleter, req openai.ChatCompletionRequest) error {
+		_, err := completer.CreateChatCompletion(ctx, req)
+		return err
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 1, calls)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, 10*time.Millisecond)
+	b.Failure("a")
+	assert.True(t, b.Allow("a"))
+	b.Failure("a")
+	assert.False(t, b.Allow("a"))
+	assert.True(t, b.Allow("b"))
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.Allow("a"))
+	b.Failure("a")
+	assert.False(t, b.Allow("a"))
+
+	b.Success("a")
+	assert.True(t, b.Allow("a"))
+
+	var nilBreaker *circuitBreaker
+	nilBreaker.Failure("a")
+	assert.True(t, nilBreaker.Allow("a"))
+}
@@ -31,7 +31,7 @@ func messageMatchCmd(msg string, cmds []string) (string, bool) {
 			return msg, true
 		}
 
-		if cmd[0] == '/' && msg[1] != '/' {
+		if cmd[0] == '/' && (len(msg) == 0 || msg[0] != '/') {
 			cmd = cmd[1:]
 		}
 
@@ -48,3 +48,11 @@ func messageMatchCmd(msg string, cmds []string) (string, bool) {
 	}
 	return msg, false
 }
+
+// matchCmdIfAny is messageMatchCmd but never matches if there is no command.
+func matchCmdIfAny(msg string, cmds []string) (string, bool) {
+	if len(cmds) == 0 {
+		return msg, false
+	}
+	return messageMatchCmd(msg, cmds)
+}
@@ -0,0 +1,213 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// generateImage draws the prompt through the OpenAI-compatible images endpoint,
+// saves the image in the media store and returns its public url.
+func (bot *Bot) generateImage(ctx context.Context, prompt string) (string, error) {
+	cfg := bot.getConfig()
+	// the image is paid for, so check that it can be served first
+	_, err := bot.mediaUrl("")
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+
+	log.Debugf("generate image: %s", prompt)
+	resp, err := bot.imageClient.CreateImage(ctx, openai.ImageRequest{
+		Prompt:         prompt,
+		Model:          cfg.ImageModel,
+		N:              1,
+		Size:           cfg.ImageSize,
+		ResponseFormat: openai.CreateImageResponseFormatB64JSON,
+	})
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+	if len(resp.Data) == 0 {
+		return "", errors.Error("images endpoint returns no image")
+	}
+
+	data, err := readGeneratedImage(ctx, &resp.Data[0])
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+
+	mime := http.DetectContentType(data)
+	if !strings.HasPrefix(mime, "image/") {
+		return "", errors.Errorf("images endpoint returns %s", mime)
+	}
+
+	name, err := bot.media.Save(data, strings.TrimPrefix(mime, "image/"))
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+
+	url, err := bot.mediaUrl(name)
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+	return url, nil
+}
+
+// readGeneratedImage decodes the image, some services ignore the response
+// format and return a temporary url, which is downloaded.
+func readGeneratedImage(ctx context.Context, img *openai.ImageResponseDataInner) ([]byte, error) {
+	if img.B64JSON != "" {
+		data, err := base64.StdEncoding.DecodeString(img.B64JSON)
+		if err != nil {
+			return nil, errors.ErrorAt(err)
+		}
+		return data, nil
+	}
+
+	if img.URL == "" {
+		return nil, errors.Error("images endpoint returns neither data nor url")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, img.URL, nil)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unable to download image: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	if len(data) > maxImageSize {
+		return nil, errors.Error("generated image is too large")
+	}
+	return data, nil
+}
+
+// drawImageTokens is counted as the tokens of a drawn image, so the daily
+// token quotas also limit the drawing.
+const drawImageTokens = 1000
+
+type DrawImageTask struct {
+	BotPath string
+	UserID  string
+	// GroupID is the conversation of the group, it is empty in the private chats.
+	GroupID string
+	Session *Session
+	Prompt  string
+	Channel Channel
+}
+
+func (task *DrawImageTask) SessionID() string {
+	return task.Session.ID
+}
+
+func (task *DrawImageTask) Do(bot *Bot) error {
+	reply := &Reply{}
+	scopes := bot.limitScopes(task.BotPath, task.UserID, task.GroupID, task.Session.GetRole())
+	if task.Prompt == "" {
+		reply.Text = "請在指令後面描述想要的圖片"
+	} else if err := bot.limiter.Allow(scopes); err != nil {
+		lerr, ok := errors.AsIs[*limitError](err)
+		if !ok {
+			return errors.ErrorAt(err)
+		}
+		log.Infof("session(%s) %v", task.Session.ID, lerr)
+		reply.Text = bot.limitText(lerr)
+	} else {
+		if task.Channel != nil {
+			err := task.Channel.ShowLoading()
+			if err != nil {
+				log.Warn(errors.GetErrorDetails(errors.ErrorAt(err)))
+			}
+		}
+
+		log.Infof("session(%s) draw: %s", task.Session.ID, task.Prompt)
+		url, err := bot.generateImage(context.Background(), task.Prompt)
+		if err != nil {
+			log.ErrorAt(err)
+			reply.Text = "小愛畫不出來:\n" + errors.GetErrorDetails(err)
+		} else {
+			bot.limiter.AddTokens(scopes, drawImageTokens)
+			reply.ImageUrls = []string{url}
+		}
+	}
+
+	if task.Channel != nil {
+		log.Debug("reply message ...")
+		err := task.Channel.Reply(reply)
+		if err != nil {
+			return errors.ErrorAt(err)
+		}
+	}
+	return nil
+}
+
+// drawImageTool lets the model draw, the image is sent with the final answer.
+type drawImageTool struct {
+	bot *Bot
+}
+
+func (tool *drawImageTool) Name() string {
+	return cfgs.ToolDrawImage
+}
+
+func (tool *drawImageTool) Description() string {
+	return "Draw an image from the description, the image is sent to the user along with your answer. Do not put the url in your answer."
+}
+
+func (tool *drawImageTool) Parameters() any {
+	return jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"prompt": {Type: jsonschema.String, Description: "Detailed description of the image in English."},
+		},
+		Required: []string{"prompt"},
+	}
+}
+
+func (tool *drawImageTool) Execute(ctx context.Context, args string) (string, error) {
+	params := struct {
+		Prompt string `json:"prompt"`
+	}{}
+	err := decodeToolArgs(args, &params)
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+	if strings.TrimSpace(params.Prompt) == "" {
+		return "", errors.Error("empty prompt")
+	}
+
+	// the image is drawn for the message which is already allowed
+	scopes := toolLimitScopes(ctx)
+	err = tool.bot.limiter.AllowQuota(scopes)
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+
+	url, err := tool.bot.generateImage(ctx, params.Prompt)
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+	tool.bot.limiter.AddTokens(scopes, drawImageTokens)
+
+	if !toolAttachImage(ctx, url) {
+		return url, nil
+	}
+	return "the image is drawn and will be sent with your answer", nil
+}
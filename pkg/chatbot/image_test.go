@@ -0,0 +1,92 @@
+package chatbot
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestImageBot(t *testing.T) *Bot {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 1, 1))))
+
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/images/generations", r.URL.Path)
+		req := map[string]any{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "dall-e-3", req["model"])
+		assert.Equal(t, "b64_json", req["response_format"])
+		if req["prompt"] == "fail" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"message":"bad prompt"}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"data":[{"b64_json":"%s"}]}`, base64.StdEncoding.EncodeToString(buf.Bytes()))
+	})
+	bot.imageClient = bot.gptClient
+	bot.media = NewMediaStore(t.TempDir())
+	bot.cfg.Store(&cfgs.Config{
+		ImageModel: "dall-e-3",
+		ImageSize:  "1024x1024",
+		PublicUrl:  "https://example.com",
+	})
+	return bot
+}
+
+func TestDrawImageTask(t *testing.T) {
+	bot := newTestImageBot(t)
+
+	ch := &fakeChannel{}
+	task := &DrawImageTask{Session: NewSession("test", "test"), Prompt: "a cat", Channel: ch}
+	assert.NoError(t, task.Do(bot))
+	if assert.Len(t, ch.replies, 1) && assert.Len(t, ch.replies[0].ImageUrls, 1) {
+		assert.Regexp(t, `^https://example.com/media/[0-9a-f]{32}\.png$`, ch.replies[0].ImageUrls[0])
+	}
+	assert.Equal(t, 1, ch.loadings)
+
+	ch = &fakeChannel{}
+	task = &DrawImageTask{Session: NewSession("test", "test"), Prompt: "fail", Channel: ch}
+	assert.NoError(t, task.Do(bot))
+	if assert.Len(t, ch.replies, 1) {
+		assert.Empty(t, ch.replies[0].ImageUrls)
+		assert.Contains(t, ch.replies[0].Text, "bad prompt")
+	}
+}
+
+func TestBot_generateImage_NoPublicUrl(t *testing.T) {
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the image is drawn without PublicUrl")
+	})
+	bot.imageClient = bot.gptClient
+	bot.cfg.Store(&cfgs.Config{ImageModel: "dall-e-3"})
+
+	_, err := bot.generateImage(context.Background(), "a cat")
+	assert.ErrorContains(t, err, "PublicUrl is not configured")
+}
+
+func Test_drawImageTool(t *testing.T) {
+	bot := newTestImageBot(t)
+	tool := &drawImageTool{bot: bot}
+
+	task := &ChatTask{Session: NewSession("test", "test"), Channel: &fakeChannel{}}
+	ctx := context.WithValue(context.Background(), toolTaskKey{}, task)
+	result, err := tool.Execute(ctx, `{"prompt":"a cat"}`)
+	assert.NoError(t, err)
+	assert.NotContains(t, result, "https://")
+	urls := task.images
+	assert.Len(t, urls, 1)
+
+	assert.NoError(t, task.replyContent("畫好了", nil))
+	ch := task.Channel.(*fakeChannel)
+	assert.Equal(t, []*Reply{{Text: "畫好了", ImageUrls: urls}}, ch.replies)
+	assert.Empty(t, task.images)
+}
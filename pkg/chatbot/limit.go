@@ -0,0 +1,262 @@
+package chatbot
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+)
+
+// limitScope is a limit with the usage it counts, e.g. a user or a role.
+type limitScope struct {
+	// name is shown in the replies
+	name  string
+	key   string
+	limit *cfgs.Limit
+}
+
+// limitScopes returns the limited scopes of the chat message, groupID is
+// empty in the private chats.
+func (bot *Bot) limitScopes(botPath, userID, groupID, roleName string) []*limitScope {
+	cfg := bot.getConfig()
+	scopes := make([]*limitScope, 0, 5)
+	add := func(name, key string, limit *cfgs.Limit) {
+		if limit != nil {
+			scopes = append(scopes, &limitScope{name: name, key: key, limit: limit})
+		}
+	}
+
+	limits := cfg.RateLimits
+	add("你", "user:"+botPath+"/"+userID, limits.UserLimit(userID))
+	if groupID != "" {
+		add("這個群組", "group:"+botPath+"/"+groupID, limits.GroupLimit(groupID))
+	}
+	if role, ok := cfg.Roles[roleName]; ok {
+		add(fmt.Sprintf("角色<%s>", roleName), "role:"+roleName, role.RateLimit)
+	}
+	if botcfg, ok := cfg.Bots[botPath]; ok {
+		add("這個機器人", "bot:"+botPath, botcfg.RateLimit)
+	}
+	add("大家", "global", limits.GlobalLimit())
+	return scopes
+}
+
+// RateLimiter counts the usages of the scopes by token buckets and daily
+// quotas. The usages are kept in memory, so they are reset by restart.
+type RateLimiter struct {
+	mu     sync.Mutex
+	usages map[string]*limitUsage
+	now    func() time.Time
+}
+
+type limitUsage struct {
+	bucket   float64
+	filledAt time.Time
+	day      string
+	requests int
+	tokens   int
+}
+
+func NewRateLimiter() *RateLimiter {
+	l := &RateLimiter{}
+	l.usages = make(map[string]*limitUsage)
+	l.now = time.Now
+	return l
+}
+
+func limitBurst(limit *cfgs.Limit) float64 {
+	return float64(max(limit.Burst, 1))
+}
+
+// usage returns the usage of the scope refilled until now. l.mu must be locked.
+func (l *RateLimiter) usage(scope *limitScope, now time.Time) *limitUsage {
+	u, ok := l.usages[scope.key]
+	if !ok {
+		u = &limitUsage{bucket: limitBurst(scope.limit), filledAt: now}
+		l.usages[scope.key] = u
+	}
+
+	if day := now.Format(time.DateOnly); u.day != day {
+		u.day = day
+		u.requests = 0
+		u.tokens = 0
+	}
+	// the limit may be changed by Reload
+	u.bucket = min(u.bucket+now.Sub(u.filledAt).Minutes()*scope.limit.RatePerMinute, limitBurst(scope.limit))
+	u.filledAt = now
+	return u
+}
+
+// limitError is the limit hit by a chat message.
+type limitError struct {
+	scope *limitScope
+	// wait is the time until the bucket has a message, zero if the daily quota
+	// is used up.
+	wait time.Duration
+}
+
+func (err *limitError) Error() string {
+	if err.wait == 0 {
+		return fmt.Sprintf("the daily quota of %s is used up", err.scope.key)
+	}
+	return fmt.Sprintf("the rate limit of %s is hit, wait %v", err.scope.key, err.wait)
+}
+
+// Allow takes a message from every scope, or from none of them if any limit
+// is hit.
+func (l *RateLimiter) Allow(scopes []*limitScope) error {
+	return l.take(scopes, true)
+}
+
+// AllowQuota takes a request from the daily quotas only. It is for the extra
+// requests of a message which is already allowed, e.g. the summary, so they do
+// not hit the rate limits of the message itself.
+func (l *RateLimiter) AllowQuota(scopes []*limitScope) error {
+	return l.take(scopes, false)
+}
+
+func (l *RateLimiter) take(scopes []*limitScope, rate bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	usages := make([]*limitUsage, 0, len(scopes))
+	for _, scope := range scopes {
+		u := l.usage(scope, now)
+		limit := scope.limit
+		if (limit.DailyRequests > 0 && u.requests >= limit.DailyRequests) || (limit.DailyTokens > 0 && u.tokens >= limit.DailyTokens) {
+			return &limitError{scope: scope}
+		}
+		if rate && limit.RatePerMinute > 0 && u.bucket < 1 {
+			wait := time.Duration((1 - u.bucket) / limit.RatePerMinute * float64(time.Minute))
+			return &limitError{scope: scope, wait: max(wait, time.Second)}
+		}
+		usages = append(usages, u)
+	}
+
+	for i, u := range usages {
+		u.requests++
+		if rate && scopes[i].limit.RatePerMinute > 0 {
+			u.bucket--
+		}
+	}
+	return nil
+}
+
+// AddTokens counts the tokens of the answered message, the drawn images and
+// the other requests of the scopes.
+func (l *RateLimiter) AddTokens(scopes []*limitScope, tokens int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for _, scope := range scopes {
+		l.usage(scope, now).tokens += tokens
+	}
+}
+
+// ClearExpired removes the usages of the previous days, their buckets are full
+// by now.
+func (l *RateLimiter) ClearExpired() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	today := l.now().Format(time.DateOnly)
+	for key, u := range l.usages {
+		if u.day != today {
+			delete(l.usages, key)
+		}
+	}
+}
+
+// Describe returns the remaining allowance of the scopes for /quota.
+func (l *RateLimiter) Describe(scopes []*limitScope) string {
+	if len(scopes) == 0 {
+		return "沒有額度限制"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	sb := &strings.Builder{}
+	sb.WriteString("今日剩餘額度:")
+	for _, scope := range scopes {
+		u := l.usage(scope, now)
+		limit := scope.limit
+		parts := make([]string, 0, 3)
+		if limit.DailyRequests > 0 {
+			parts = append(parts, fmt.Sprintf("%d/%d 次", max(limit.DailyRequests-u.requests, 0), limit.DailyRequests))
+		}
+		if limit.DailyTokens > 0 {
+			parts = append(parts, fmt.Sprintf("%d/%d tokens", max(limit.DailyTokens-u.tokens, 0), limit.DailyTokens))
+		}
+		if limit.RatePerMinute > 0 {
+			parts = append(parts, fmt.Sprintf("每分鐘 %g 次，現在可連續問 %d 次", limit.RatePerMinute, int(u.bucket)))
+		}
+		if len(parts) == 0 {
+			parts = append(parts, "沒有限制")
+		}
+		fmt.Fprintf(sb, "\n%s: %s", scope.name, strings.Join(parts, "、"))
+	}
+	return sb.String()
+}
+
+// limitText returns the reply of the hit limit.
+func (bot *Bot) limitText(lerr *limitError) string {
+	cfg := bot.getConfig()
+	var text string
+	if lerr.wait == 0 {
+		text = fmt.Sprintf("%s今天的額度用完了，明天再來找小愛吧", lerr.scope.name)
+	} else {
+		text = fmt.Sprintf("%s問得太快了，請 %d 秒後再問小愛", lerr.scope.name, int(math.Ceil(lerr.wait.Seconds())))
+	}
+	if len(cfg.CmdsShowQuota) != 0 {
+		text += fmt.Sprintf("\n輸入 %s 可以查看剩餘額度", cfg.CmdsShowQuota[0])
+	}
+	return text
+}
+
+// replyLimited tells the user which limit is hit.
+func (task *ChatTask) replyLimited(bot *Bot, err error) error {
+	lerr, ok := errors.AsIs[*limitError](err)
+	if !ok {
+		return errors.ErrorAt(err)
+	}
+	log.Infof("session(%s) %v", task.Session.ID, lerr)
+
+	err = task.reply(&Reply{Text: bot.limitText(lerr)})
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	return nil
+}
+
+type ShowQuotaTask struct {
+	BotPath string
+	UserID  string
+	GroupID string
+	Session *Session
+	Channel Channel
+}
+
+func (task *ShowQuotaTask) SessionID() string {
+	return task.Session.ID
+}
+
+func (task *ShowQuotaTask) Do(bot *Bot) error {
+	scopes := bot.limitScopes(task.BotPath, task.UserID, task.GroupID, task.Session.GetRole())
+	if task.Channel != nil {
+		log.Debug("reply message ...")
+		err := task.Channel.Reply(&Reply{Text: bot.limiter.Describe(scopes)})
+		if err != nil {
+			return errors.ErrorAt(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package chatbot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	l := NewRateLimiter()
+	l.now = func() time.Time { return now }
+
+	user := &limitScope{name: "你", key: "user:/linebot/U1", limit: &cfgs.Limit{RatePerMinute: 6, Burst: 2, DailyRequests: 3}}
+	global := &limitScope{name: "大家", key: "global", limit: &cfgs.Limit{DailyTokens: 100}}
+	scopes := []*limitScope{user, global}
+
+	assert.NoError(t, l.Allow(scopes))
+	assert.NoError(t, l.Allow(scopes))
+	err := l.Allow(scopes)
+	assert.Equal(t, &limitError{scope: user, wait: 10 * time.Second}, err)
+
+	// the bucket is refilled
+	now = now.Add(10 * time.Second)
+	assert.NoError(t, l.Allow(scopes))
+	now = now.Add(time.Minute)
+	assert.Equal(t, &limitError{scope: user}, l.Allow(scopes))
+
+	// the rejected messages do not count
+	assert.Equal(t, "今日剩餘額度:\n你: 0/3 次、每分鐘 6 次，現在可連續問 2 次\n大家: 100/100 tokens", l.Describe(scopes))
+	l.AddTokens(scopes, 100)
+	assert.Equal(t, &limitError{scope: global}, l.Allow([]*limitScope{global}))
+
+	// the quotas are reset the next day
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, l.Allow(scopes))
+	l.ClearExpired()
+	assert.Len(t, l.usages, 2)
+}
+
+func TestBot_Chat_Quota(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"你好"},"finish_reason":"stop"}]}`)
+	}))
+	defer server.Close()
+
+	cfg := newTestReloadConfig(t)
+	cfg.ChatGptApiUrl = server.URL
+	cfg.Bots = map[string]*cfgs.Bot{"/terminal": {Platform: cfgs.PlatformTerminal, DefaultRole: "A"}}
+	cfg.RateLimits = &cfgs.RateLimits{
+		PerUser: &cfgs.Limit{DailyRequests: 1},
+		IDs:     map[string]*cfgs.Limit{"Bob": {DailyRequests: 2}},
+	}
+	bot, err := NewBot(cfg)
+	assert.NoError(t, err)
+	go bot.DoTasks()
+	defer bot.Stop()
+
+	in := strings.Join([]string{"hi", "hi again", "/quota", ":user Bob", "/quota"}, "\n")
+	out := &strings.Builder{}
+	err = bot.Chat(strings.NewReader(in), out, &ChatOptions{BotPath: "/terminal", UserName: "Alice"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, strings.Join([]string{
+		"Alice> 🤖 你好",
+		"Alice> 🤖 你今天的額度用完了，明天再來找小愛吧",
+		"輸入 /quota 可以查看剩餘額度",
+		"Alice> 🤖 今日剩餘額度:",
+		"你: 0/1 次",
+		"Alice> Bob> 🤖 今日剩餘額度:",
+		"你: 2/2 次",
+		"Bob> ",
+		"",
+	}, "\n"), out.String())
+}
+
+func TestDrawImageTask_Limit(t *testing.T) {
+	bot := newTestImageBot(t)
+	bot.getConfig().RateLimits = &cfgs.RateLimits{PerUser: &cfgs.Limit{DailyRequests: 1}}
+
+	ch := &fakeChannel{}
+	task := &DrawImageTask{BotPath: "/linebot", UserID: "U1", Session: NewSession("test", "test"), Prompt: "a cat", Channel: ch}
+	assert.NoError(t, task.Do(bot))
+	assert.NoError(t, task.Do(bot))
+	if assert.Len(t, ch.replies, 2) {
+		assert.Len(t, ch.replies[0].ImageUrls, 1)
+		assert.Equal(t, &Reply{Text: "你今天的額度用完了，明天再來找小愛吧"}, ch.replies[1])
+	}
+	assert.Equal(t, drawImageTokens, bot.limiter.usages["user:/linebot/U1"].tokens)
+}
+
+func Test_drawImageTool_Limit(t *testing.T) {
+	bot := newTestImageBot(t)
+	bot.getConfig().RateLimits = &cfgs.RateLimits{PerUser: &cfgs.Limit{RatePerMinute: 1, DailyRequests: 2}}
+	tool := &drawImageTool{bot: bot}
+
+	task := &ChatTask{Session: NewSession("test", "test"), Channel: &fakeChannel{}}
+	task.scopes = bot.limitScopes("/linebot", "U1", "", "")
+	assert.NoError(t, bot.limiter.Allow(task.scopes))
+	ctx := context.WithValue(context.Background(), toolTaskKey{}, task)
+
+	// the rate limit is taken by the message itself
+	_, err := tool.Execute(ctx, `{"prompt":"a cat"}`)
+	assert.NoError(t, err)
+	_, err = tool.Execute(ctx, `{"prompt":"a dog"}`)
+	assert.ErrorContains(t, err, "the daily quota of user:/linebot/U1 is used up")
+	assert.Len(t, task.images, 1)
+	assert.Equal(t, drawImageTokens, bot.limiter.usages["user:/linebot/U1"].tokens)
+}
+
+func TestChatTask_summarizeMessages_Limit(t *testing.T) {
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"摘要"}}]}`)
+	})
+
+	task := &ChatTask{Session: NewSession("test", "test")}
+	task.scopes = []*limitScope{{name: "你", key: "user:/linebot/U1", limit: &cfgs.Limit{DailyRequests: 1}}}
+	role := &cfgs.Role{SummarizeThreshold: 2}
+	msgs := newTestMessages("q1", "a1", "q2", "a2", "q3")
+
+	summarized, err := task.summarizeMessages(bot, role, "gpt-3.5-turbo", msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, "摘要", getSummary(summarized))
+	assert.Positive(t, bot.limiter.usages["user:/linebot/U1"].tokens)
+
+	_, err = task.summarizeMessages(bot, role, "gpt-3.5-turbo", msgs)
+	assert.ErrorContains(t, err, "the daily quota of user:/linebot/U1 is used up")
+}
+
+func TestApi_ChatCompletions_Limit(t *testing.T) {
+	bot, reqs := newTestApiBot(t)
+	bot.getConfig().ApiTokens = []string{"secret", "other", "third"}
+	bot.getConfig().RateLimits = &cfgs.RateLimits{
+		PerUser: &cfgs.Limit{DailyTokens: 1},
+		IDs:     map[string]*cfgs.Limit{apiTokenUserID("third"): {RatePerMinute: 1}},
+	}
+
+	for i, token := range []string{"secret", "other"} {
+		stream := i == 1
+		body := fmt.Sprintf(`{"model":"A","stream":%v,"user":"u1","messages":[{"role":"user","content":"hi"}]}`, stream)
+		w := doApiRequest(bot, http.MethodPost, "/v1/chat/completions", token, body)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// the tokens of the answer use up the quota, the user of the request does not matter
+		body = fmt.Sprintf(`{"model":"A","stream":%v,"user":"u2","messages":[{"role":"user","content":"hi"}]}`, stream)
+		w = doApiRequest(bot, http.MethodPost, "/v1/chat/completions", token, body)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"rate_limit_exceeded"`)
+		assert.Contains(t, w.Body.String(), "the daily quota of user:/v1/chat/completions/"+apiTokenUserID(token))
+		assert.NotContains(t, w.Body.String(), token)
+	}
+	assert.Len(t, *reqs, 2)
+
+	body := `{"model":"A","messages":[{"role":"user","content":"hi"}]}`
+	w := doApiRequest(bot, http.MethodPost, "/v1/chat/completions", "third", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doApiRequest(bot, http.MethodPost, "/v1/chat/completions", "third", body)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+}
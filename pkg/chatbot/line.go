@@ -1,24 +1,70 @@
 package chatbot
 
 import (
+	"io"
 	"net/http"
-	"path"
-	"strings"
-	"unicode"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jopbrown/gobase/errors"
 	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
 	"github.com/line/line-bot-sdk-go/v8/linebot"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
 )
 
-func (bot *Bot) linebotCallback(c *gin.Context) {
-	fpath := c.FullPath()
-	client := bot.lineClients[fpath]
+type lineMessenger struct {
+	router    Router
+	fpath     string
+	client    *linebot.Client
+	api       *messaging_api.MessagingApiAPI
+	botUserID string
 
-	defaultRole := bot.cfg.Bots[c.FullPath()].DefaultRole
+	userNameMu    sync.RWMutex
+	userNameCache map[string]string
+}
+
+func newLineMessenger(router Router, fpath string, botcfg *cfgs.Bot) (*lineMessenger, error) {
+	m := &lineMessenger{}
+	m.router = router
+	m.fpath = fpath
+	m.userNameCache = make(map[string]string)
+
+	client, err := linebot.New(botcfg.LineChannelSecret, botcfg.LineChannelToken)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	m.client = client
+
+	api, err := messaging_api.NewMessagingApiAPI(botcfg.LineChannelToken)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	m.api = api
+
+	botInfo, err := client.GetBotInfo().Do()
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	m.botUserID = botInfo.UserID
+	m.userNameCache[fpath] = botInfo.DisplayName
+
+	return m, nil
+}
 
-	events, err := client.ParseRequest(c.Request)
+func (m *lineMessenger) Platform() string {
+	return cfgs.PlatformLine
+}
+
+func (m *lineMessenger) Handler() gin.HandlerFunc {
+	return m.linebotCallback
+}
+
+func (m *lineMessenger) Run(stop <-chan struct{}) {}
+
+func (m *lineMessenger) linebotCallback(c *gin.Context) {
+	events, err := m.client.ParseRequest(c.Request)
 	if err != nil {
 		if err == linebot.ErrInvalidSignature {
 			c.JSON(http.StatusBadRequest, gin.H{"message": linebot.ErrInvalidSignature})
@@ -29,96 +75,246 @@ func (bot *Bot) linebotCallback(c *gin.Context) {
 	}
 
 	for _, event := range events {
-		if event.Type == linebot.EventTypeMessage {
-			sessionID := path.Join(fpath, lineGetSessionID(event))
-			session := bot.sessMgr.GetSession(sessionID, defaultRole)
-			switch message := event.Message.(type) {
-			case *linebot.TextMessage:
-				msg := strings.TrimLeftFunc(message.Text, unicode.IsSpace)
-				if _, ok := messageMatchCmd(msg, bot.cfg.CmdsClearSession); ok {
-					bot.taskQueue <- &ClearSessionTask{
-						Session: session,
-						ReplyFn: bot.lineReplyFnWithToken(client, event.ReplyToken),
-					}
-				} else if role, ok := messageMatchCmd(msg, bot.cfg.CmdsChangeRole); ok {
-					bot.taskQueue <- &ChangeRoleTask{
-						Session: session,
-						Role:    role,
-						ReplyFn: bot.lineReplyFnWithToken(client, event.ReplyToken),
-					}
-				} else {
-					userName, err := bot.lineGetUserName(client, event.Source.UserID)
-					if err != nil {
-						log.ErrorAt(err)
-						continue
-					}
-					botName, err := bot.lineGetBotName(client, fpath)
-					if err != nil {
-						log.ErrorAt(err)
-						continue
-					}
-					bot.taskQueue <- &ChatTask{
-						UserName: userName,
-						BotName:  botName,
-						Session:  session,
-						Message:  msg,
-						IsGroup:  lineIsGroupEvent(event),
-						ReplyFn:  bot.lineReplyFnWithToken(client, event.ReplyToken),
-					}
-				}
+		if event.Type != linebot.EventTypeMessage {
+			continue
+		}
 
-			default:
-				// ignore other message types
-			}
+		ev, err := m.newEvent(event)
+		if err != nil {
+			log.ErrorAt(err)
+			continue
 		}
+		if ev == nil {
+			// ignore other message types
+			continue
+		}
+
+		m.router.Dispatch(ev, m.newChannel(event))
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "success"})
 }
 
-func (bot *Bot) lineReplyFnWithToken(client *linebot.Client, token string) func(string, ...string) error {
-	return func(reply string, imgUrls ...string) error {
-		msgs := make([]linebot.SendingMessage, 0, 1+len(imgUrls))
-		msgs = append(msgs, linebot.NewTextMessage(reply))
-		for _, url := range imgUrls {
-			msgs = append(msgs, linebot.NewImageMessage(url, url))
-		}
-		if _, err := client.ReplyMessage(token, msgs...).Do(); err != nil {
-			return errors.ErrorAt(err)
+func (m *lineMessenger) newEvent(event *linebot.Event) (*Event, error) {
+	ev := &Event{}
+	ev.BotPath = m.fpath
+	ev.ConversationID = lineGetSessionID(event)
+	ev.UserID = event.Source.UserID
+	ev.IsGroup = lineIsGroupEvent(event)
+
+	switch message := event.Message.(type) {
+	case *linebot.TextMessage:
+		ev.Text = message.Text
+		if message.Mention != nil {
+			for _, mentionee := range message.Mention.Mentionees {
+				if mentionee.UserID == "" {
+					continue
+				}
+				ev.Mentions = append(ev.Mentions, mentionee.UserID)
+				if mentionee.UserID == m.botUserID {
+					ev.Mentioned = true
+				}
+			}
 		}
-		return nil
+	case *linebot.ImageMessage:
+		ev.Attachments = append(ev.Attachments, m.newAttachment(AttachmentImage, message.ID))
+	case *linebot.AudioMessage:
+		attachment := m.newAttachment(AttachmentAudio, message.ID)
+		// LINE records voice messages in m4a
+		attachment.Name = message.ID + ".m4a"
+		ev.Attachments = append(ev.Attachments, attachment)
+	case *linebot.VideoMessage:
+		ev.Attachments = append(ev.Attachments, m.newAttachment(AttachmentVideo, message.ID))
+	case *linebot.FileMessage:
+		ev.Attachments = append(ev.Attachments, m.newAttachment(AttachmentFile, message.ID))
+	default:
+		return nil, nil
 	}
+
+	userName, err := m.lineGetUserName(event.Source.UserID)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	ev.UserName = userName
+
+	botName, err := m.lineGetBotName()
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	ev.BotName = botName
+
+	return ev, nil
 }
 
-func (bot *Bot) lineGetBotName(client *linebot.Client, fpath string) (string, error) {
-	if userName, ok := bot.userNameCache[fpath]; ok {
+func (m *lineMessenger) newAttachment(typ, messageID string) *Attachment {
+	return &Attachment{
+		Type: typ,
+		ID:   messageID,
+		Open: func() (io.ReadCloser, error) {
+			content, err := m.client.GetMessageContent(messageID).Do()
+			if err != nil {
+				return nil, errors.ErrorAt(err)
+			}
+			return content.Content, nil
+		},
+	}
+}
+
+func (m *lineMessenger) newChannel(event *linebot.Event) *lineChannel {
+	ch := &lineChannel{}
+	ch.client = m.client
+	ch.api = m.api
+	ch.replyToken = event.ReplyToken
+	ch.to = lineGetSessionID(event)
+	if !lineIsGroupEvent(event) {
+		ch.loadingChatID = event.Source.UserID
+	}
+	return ch
+}
+
+func (m *lineMessenger) lineGetBotName() (string, error) {
+	m.userNameMu.RLock()
+	userName, ok := m.userNameCache[m.fpath]
+	m.userNameMu.RUnlock()
+	if ok {
 		return userName, nil
 	}
-	botInfo, err := client.GetBotInfo().Do()
+
+	botInfo, err := m.client.GetBotInfo().Do()
 	if err != nil {
-		log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to get bot info: %q", fpath)))
+		log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to get bot info: %q", m.fpath)))
+		return "", nil
 	}
-	userName := botInfo.DisplayName
-	bot.userNameCache[fpath] = userName
+	userName = botInfo.DisplayName
+	m.userNameMu.Lock()
+	m.userNameCache[m.fpath] = userName
+	m.userNameMu.Unlock()
 
 	return userName, nil
 }
 
-func (bot *Bot) lineGetUserName(client *linebot.Client, userID string) (string, error) {
-	if userName, ok := bot.userNameCache[userID]; ok {
+func (m *lineMessenger) lineGetUserName(userID string) (string, error) {
+	m.userNameMu.RLock()
+	userName, ok := m.userNameCache[userID]
+	m.userNameMu.RUnlock()
+	if ok {
 		return userName, nil
 	}
-	profile, err := client.GetProfile(userID).Do()
+
+	profile, err := m.client.GetProfile(userID).Do()
 	if err != nil {
 		log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to get user profile: %s", userID)))
 		return "路人甲", nil
 	}
-	userName := profile.DisplayName
-	bot.userNameCache[userID] = userName
+	userName = profile.DisplayName
+	m.userNameMu.Lock()
+	m.userNameCache[userID] = userName
+	m.userNameMu.Unlock()
 
 	return userName, nil
 }
 
+type lineChannel struct {
+	client        *linebot.Client
+	api           *messaging_api.MessagingApiAPI
+	replyToken    string
+	to            string
+	loadingChatID string
+}
+
+// Reply replies the first messages, the others are pushed since a reply
+// token is used once.
+func (ch *lineChannel) Reply(reply *Reply) error {
+	batches := lineSendingBatches(reply)
+	if _, err := ch.client.ReplyMessage(ch.replyToken, batches[0]...).Do(); err != nil {
+		return errors.ErrorAt(err)
+	}
+	return ch.push(batches[1:])
+}
+
+func (ch *lineChannel) Push(reply *Reply) error {
+	return ch.push(lineSendingBatches(reply))
+}
+
+func (ch *lineChannel) push(batches [][]linebot.SendingMessage) error {
+	for _, msgs := range batches {
+		if _, err := ch.client.PushMessage(ch.to, msgs...).Do(); err != nil {
+			return errors.ErrorAt(err)
+		}
+	}
+	return nil
+}
+
+// ShowLoading does nothing in groups, since LINE only displays the loading
+// indicator in one-on-one chats.
+func (ch *lineChannel) ShowLoading() error {
+	if ch.loadingChatID == "" {
+		return nil
+	}
+
+	_, err := ch.api.ShowLoadingAnimation(&messaging_api.ShowLoadingAnimationRequest{
+		ChatId:         ch.loadingChatID,
+		LoadingSeconds: 60,
+	})
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	return nil
+}
+
+const (
+	lineMaxQuickReplyItems = 13
+	lineMaxQuickReplyLabel = 20
+	// lineMaxSendingMessages is the limit of the messages in a request.
+	lineMaxSendingMessages = 5
+)
+
+// lineSendingBatches splits the messages of the reply into the requests, the
+// quick replies are attached to the last message. There is at least one batch.
+func lineSendingBatches(reply *Reply) [][]linebot.SendingMessage {
+	msgs := lineSendingMessages(reply)
+	batches := make([][]linebot.SendingMessage, 0, 1+len(msgs)/lineMaxSendingMessages)
+	for len(msgs) > lineMaxSendingMessages {
+		batches = append(batches, msgs[:lineMaxSendingMessages])
+		msgs = msgs[lineMaxSendingMessages:]
+	}
+	return append(batches, msgs)
+}
+
+func lineSendingMessages(reply *Reply) []linebot.SendingMessage {
+	msgs := make([]linebot.SendingMessage, 0, 1+len(reply.ImageUrls))
+	if reply.Text != "" {
+		msgs = append(msgs, linebot.NewTextMessage(reply.Text))
+	}
+	for _, url := range reply.ImageUrls {
+		msgs = append(msgs, linebot.NewImageMessage(url, url))
+	}
+	if reply.Audio != nil {
+		msgs = append(msgs, linebot.NewAudioMessage(reply.Audio.Url, int(reply.Audio.Duration.Milliseconds())))
+	}
+
+	if len(reply.QuickReplies) != 0 && len(msgs) != 0 {
+		buttons := make([]*linebot.QuickReplyButton, 0, lineMaxQuickReplyItems)
+		for _, qr := range reply.QuickReplies {
+			if len(buttons) == lineMaxQuickReplyItems {
+				break
+			}
+			buttons = append(buttons, linebot.NewQuickReplyButton("", linebot.NewMessageAction(lineTruncateLabel(qr.Label), qr.Text)))
+		}
+		last := len(msgs) - 1
+		msgs[last] = msgs[last].WithQuickReplies(linebot.NewQuickReplyItems(buttons...))
+	}
+
+	return msgs
+}
+
+func lineTruncateLabel(label string) string {
+	if utf8.RuneCountInString(label) <= lineMaxQuickReplyLabel {
+		return label
+	}
+	return string([]rune(label)[:lineMaxQuickReplyLabel])
+}
+
 func lineIsGroupEvent(event *linebot.Event) bool {
 	switch event.Source.Type {
 	case linebot.EventSourceTypeRoom, linebot.EventSourceTypeGroup:
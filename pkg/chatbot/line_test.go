@@ -0,0 +1,32 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_lineSendingBatches(t *testing.T) {
+	batches := lineSendingBatches(&Reply{Text: "hi"})
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0], 1)
+
+	reply := &Reply{
+		Text:         "畫好了",
+		ImageUrls:    []string{"1.png", "2.png", "3.png", "4.png", "5.png", "6.png"},
+		QuickReplies: []*QuickReply{{Label: "再畫一張", Text: "/draw"}},
+	}
+	batches = lineSendingBatches(reply)
+	if assert.Len(t, batches, 2) {
+		assert.Len(t, batches[0], lineMaxSendingMessages)
+		assert.Len(t, batches[1], 2)
+
+		data, err := json.Marshal(batches[1][1])
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), "quickReply")
+		data, err = json.Marshal(batches[0][4])
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), "quickReply")
+	}
+}
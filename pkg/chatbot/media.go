@@ -0,0 +1,119 @@
+package chatbot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/fsutil"
+)
+
+// MediaStore keeps the generated media files under Dir, they are served by the
+// bot's HTTP server so the platforms can fetch them.
+type MediaStore struct {
+	Dir string
+}
+
+func NewMediaStore(dir string) *MediaStore {
+	return &MediaStore{Dir: dir}
+}
+
+var reMediaName = regexp.MustCompile(`^[0-9a-f]{32}\.[0-9a-z]+$`)
+
+// Save writes the data and returns the file name, which is named by the hash of
+// the data, so the same content is saved only once.
+func (store *MediaStore) Save(data []byte, ext string) (string, error) {
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:16]) + "." + strings.TrimPrefix(ext, ".")
+	if !reMediaName.MatchString(name) {
+		return "", errors.Errorf("invalid media extension: %s", ext)
+	}
+
+	fname := filepath.Join(store.Dir, name)
+	if fsutil.ExistsFile(fname) {
+		return name, nil
+	}
+
+	f, err := fsutil.OpenFileWrite(fname + ".tmp")
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+
+	err = os.Rename(fname+".tmp", fname)
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+
+	return name, nil
+}
+
+// Path returns the path of the media file, false if the name is invalid.
+func (store *MediaStore) Path(name string) (string, bool) {
+	if !reMediaName.MatchString(name) {
+		return "", false
+	}
+	return filepath.Join(store.Dir, name), true
+}
+
+// ClearExpired removes the files older than the period and returns their names.
+func (store *MediaStore) ClearExpired(period time.Duration) ([]string, error) {
+	names := make([]string, 0)
+	if !fsutil.ExistsDir(store.Dir) {
+		return names, nil
+	}
+
+	entries, err := os.ReadDir(store.Dir)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || now.Sub(info.ModTime()) <= period {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(store.Dir, entry.Name()))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return names, errors.ErrorAt(err)
+		}
+		names = append(names, entry.Name())
+	}
+
+	return names, nil
+}
+
+// mediaUrl returns the public url of the media file.
+func (bot *Bot) mediaUrl(name string) (string, error) {
+	cfg := bot.getConfig()
+	if cfg.PublicUrl == "" {
+		return "", errors.Error("PublicUrl is not configured")
+	}
+	return strings.TrimSuffix(cfg.PublicUrl, "/") + "/media/" + name, nil
+}
+
+func (bot *Bot) mediaHandler(c *gin.Context) {
+	fname, ok := bot.media.Path(c.Param("name"))
+	if !ok || !fsutil.ExistsFile(fname) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "not found"})
+		return
+	}
+	c.File(fname)
+}
@@ -0,0 +1,96 @@
+package chatbot
+
+import (
+	"io"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+)
+
+// Messenger connects a chat platform to the bot. It normalizes the incoming
+// events into Event and passes them to the Router with a Channel to answer.
+type Messenger interface {
+	Platform() string
+	// Handler returns the webhook handler, nil if the messenger does not receive webhooks.
+	Handler() gin.HandlerFunc
+	// Run does background work like long polling until stop is closed.
+	Run(stop <-chan struct{})
+}
+
+type Router interface {
+	Dispatch(ev *Event, ch Channel) bool
+}
+
+// Channel sends messages back to the conversation which the event comes from.
+type Channel interface {
+	// Reply answers the event, some platforms only accept one reply per event.
+	Reply(reply *Reply) error
+	// Push sends a message to the conversation at any time.
+	Push(reply *Reply) error
+	ShowLoading() error
+}
+
+type Event struct {
+	BotPath        string
+	ConversationID string
+	UserID         string
+	UserName       string
+	BotName        string
+	IsGroup        bool
+	Mentioned      bool
+	Mentions       []string
+	Text           string
+	Attachments    []*Attachment
+}
+
+func (ev *Event) SessionID() string {
+	return path.Join(ev.BotPath, ev.ConversationID)
+}
+
+const (
+	AttachmentImage = "image"
+	AttachmentAudio = "audio"
+	AttachmentVideo = "video"
+	AttachmentFile  = "file"
+)
+
+type Attachment struct {
+	Type string
+	ID   string
+	// Name is the file name if known, the extension tells the format of audio.
+	Name string
+	Open func() (io.ReadCloser, error)
+}
+
+type Reply struct {
+	Text         string
+	ImageUrls    []string
+	Audio        *ReplyAudio
+	QuickReplies []*QuickReply
+}
+
+type ReplyAudio struct {
+	Url      string
+	Duration time.Duration
+}
+
+type QuickReply struct {
+	Label string
+	Text  string
+}
+
+func newMessenger(router Router, fpath string, botcfg *cfgs.Bot) (Messenger, error) {
+	switch botcfg.GetPlatform() {
+	case cfgs.PlatformLine:
+		return newLineMessenger(router, fpath, botcfg)
+	case cfgs.PlatformTelegram:
+		return newTelegramMessenger(router, fpath, botcfg)
+	case cfgs.PlatformTerminal:
+		return &terminalMessenger{}, nil
+	}
+
+	return nil, errors.Errorf("unknown platform of bot %s: %q", fpath, botcfg.Platform)
+}
@@ -0,0 +1,210 @@
+package chatbot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+)
+
+// ChatCompleter is a chat completion backend. The requests and responses are in
+// the OpenAI format, the other providers convert them to their own APIs. The
+// errors are *openai.APIError, so GetOpenAIErrCode works for every provider.
+type ChatCompleter interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatCompletionStream, error)
+}
+
+// ChatCompletionStream receives the answer chunk by chunk until io.EOF.
+type ChatCompletionStream interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+func newChatCompleter(p *cfgs.Provider) (ChatCompleter, error) {
+	switch p.GetType() {
+	case cfgs.ProviderOpenAI:
+		gptCfg := openai.DefaultConfig(p.AccessToken)
+		if p.ApiUrl != "" {
+			gptCfg.BaseURL = p.ApiUrl
+		}
+		return newOpenAIChatCompleter(openai.NewClientWithConfig(gptCfg)), nil
+	case cfgs.ProviderAzure:
+		gptCfg := openai.DefaultAzureConfig(p.AccessToken, p.ApiUrl)
+		if p.ApiVersion != "" {
+			gptCfg.APIVersion = p.ApiVersion
+		}
+		// the model is the deployment name
+		gptCfg.AzureModelMapperFunc = func(model string) string { return model }
+		return newOpenAIChatCompleter(openai.NewClientWithConfig(gptCfg)), nil
+	case cfgs.ProviderAnthropic:
+		return newAnthropicChatCompleter(p), nil
+	case cfgs.ProviderOllama:
+		return newOllamaChatCompleter(p), nil
+	}
+	return nil, errors.Errorf("unknown provider type: %s", p.Type)
+}
+
+// newChatCompleters builds the providers of the config, including the default one.
+func newChatCompleters(cfg *cfgs.Config) (map[string]ChatCompleter, error) {
+	completers := make(map[string]ChatCompleter, len(cfg.Providers)+1)
+	names := []string{cfgs.DefaultProvider}
+	for name := range cfg.Providers {
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		p, _ := cfg.GetProvider(name)
+		completer, err := newChatCompleter(p)
+		if err != nil {
+			return nil, errors.ErrorAtf(err, "invalid provider: %s", name)
+		}
+		completers[name] = completer
+	}
+	return completers, nil
+}
+
+// chatRoute is a provider and the model to chat with.
+type chatRoute struct {
+	provider  string
+	completer ChatCompleter
+	model     string
+}
+
+// chatRoute returns the provider and model of the role in the bot. The role
+// overrides the bot, the bot overrides the default provider and ChatGptModel.
+func (bot *Bot) chatRoute(botPath string, role *cfgs.Role) (*chatRoute, error) {
+	botcfg, ok := bot.getConfig().Bots[botPath]
+	if !ok {
+		botcfg = &cfgs.Bot{}
+	}
+
+	name, model := role.Provider, role.Model
+	if name == "" {
+		name = botcfg.Provider
+		if model == "" {
+			model = botcfg.Model
+		}
+	}
+	return bot.newChatRoute(name, model)
+}
+
+// newChatRoute resolves the empty name to the default provider and the empty
+// model to the model of the provider or ChatGptModel.
+func (bot *Bot) newChatRoute(name, model string) (*chatRoute, error) {
+	cfg := bot.getConfig()
+	if name == "" {
+		name = cfgs.DefaultProvider
+	}
+
+	completer, ok := bot.providers[name]
+	if !ok {
+		return nil, errors.Errorf("unknown provider: %s", name)
+	}
+
+	if model == "" {
+		if p, ok := cfg.GetProvider(name); ok {
+			model = p.Model
+		}
+	}
+	if model == "" {
+		model = cfg.ChatGptModel
+	}
+
+	return &chatRoute{provider: name, completer: completer, model: model}, nil
+}
+
+type openAIChatCompleter struct {
+	client *openai.Client
+}
+
+func newOpenAIChatCompleter(client *openai.Client) *openAIChatCompleter {
+	return &openAIChatCompleter{client: client}
+}
+
+func (c *openAIChatCompleter) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return c.client.CreateChatCompletion(ctx, req)
+}
+
+func (c *openAIChatCompleter) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatCompletionStream, error) {
+	stream, err := c.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// newProviderError maps the error of the provider to the status codes of the
+// OpenAI errors, which decide the message replied to the user.
+func newProviderError(statusCode int, errType string, msg string) error {
+	code := statusCode
+	switch {
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden,
+		strings.Contains(errType, "authentication"), strings.Contains(errType, "permission"):
+		code = http.StatusUnauthorized
+	case statusCode >= http.StatusInternalServerError, strings.Contains(errType, "overloaded"):
+		// e.g. 529 overloaded of Anthropic
+		code = http.StatusInternalServerError
+	}
+
+	return &openai.APIError{
+		Type:           errType,
+		Message:        msg,
+		HTTPStatusCode: code,
+	}
+}
+
+// providerHttpClient bounds the connection and the wait for the response
+// headers. The body is bounded by ctx only, since the streams may last long.
+var providerHttpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Minute,
+	},
+}
+
+// postProviderJSON posts the body to the provider and returns the response if
+// it succeeds, otherwise the error decoded by decodeErr.
+func postProviderJSON(ctx context.Context, url string, header http.Header, body any, decodeErr func(statusCode int, data []byte) error) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := providerHttpClient.Do(req)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return nil, decodeErr(resp.StatusCode, data)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,358 @@
+package chatbot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	anthropicDefaultApiUrl     = "https://api.anthropic.com/v1"
+	anthropicDefaultApiVersion = "2023-06-01"
+	// anthropicDefaultMaxTokens is used when the request does not limit the
+	// tokens, since the Messages API requires max_tokens.
+	anthropicDefaultMaxTokens = 4096
+	// anthropicMaxTemperature caps the temperature, Anthropic accepts 0 to 1
+	// while OpenAI accepts up to 2.
+	anthropicMaxTemperature = 1
+)
+
+// anthropicChatCompleter talks to the Anthropic Messages API.
+type anthropicChatCompleter struct {
+	apiUrl      string
+	accessToken string
+	apiVersion  string
+}
+
+func newAnthropicChatCompleter(p *cfgs.Provider) *anthropicChatCompleter {
+	c := &anthropicChatCompleter{}
+	c.apiUrl = strings.TrimSuffix(p.ApiUrl, "/")
+	if c.apiUrl == "" {
+		c.apiUrl = anthropicDefaultApiUrl
+	}
+	c.accessToken = p.AccessToken
+	c.apiVersion = p.ApiVersion
+	if c.apiVersion == "" {
+		c.apiVersion = anthropicDefaultApiVersion
+	}
+	return c
+}
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	System        string             `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   float32            `json:"temperature,omitempty"`
+	TopP          float32            `json:"top_p,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Tools         []anthropicTool    `json:"tools,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string              `json:"role"`
+	Content []*anthropicContent `json:"content"`
+}
+
+type anthropicContent struct {
+	Type      string                `json:"type"`
+	Text      string                `json:"text,omitempty"`
+	Source    *anthropicImageSource `json:"source,omitempty"`
+	ID        string                `json:"id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Input     json.RawMessage       `json:"input,omitempty"`
+	ToolUseID string                `json:"tool_use_id,omitempty"`
+	Content   string                `json:"content,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	Url       string `json:"url,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type anthropicResponse struct {
+	ID         string              `json:"id"`
+	Model      string              `json:"model"`
+	Content    []*anthropicContent `json:"content"`
+	StopReason string              `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+type anthropicError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *anthropicChatCompleter) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	resp, err := c.post(ctx, req, false)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	aresp := &anthropicResponse{}
+	err = json.NewDecoder(resp.Body).Decode(aresp)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, errors.ErrorAt(err)
+	}
+
+	msg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	texts := make([]string, 0, len(aresp.Content))
+	for _, content := range aresp.Content {
+		switch content.Type {
+		case "text":
+			texts = append(texts, content.Text)
+		case "tool_use":
+			msg.ToolCalls = append(msg.ToolCalls, openai.ToolCall{
+				ID:   content.ID,
+				Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{
+					Name:      content.Name,
+					Arguments: string(content.Input),
+				},
+			})
+		}
+	}
+	msg.Content = strings.Join(texts, "")
+
+	return openai.ChatCompletionResponse{
+		ID:      aresp.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   aresp.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      msg,
+			FinishReason: anthropicFinishReason(aresp.StopReason),
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     aresp.Usage.InputTokens,
+			CompletionTokens: aresp.Usage.OutputTokens,
+			TotalTokens:      aresp.Usage.InputTokens + aresp.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+func (c *anthropicChatCompleter) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatCompletionStream, error) {
+	resp, err := c.post(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	return &anthropicStream{body: resp.Body, reader: bufio.NewReader(resp.Body)}, nil
+}
+
+func (c *anthropicChatCompleter) post(ctx context.Context, req openai.ChatCompletionRequest, stream bool) (*http.Response, error) {
+	areq, err := newAnthropicRequest(req)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	areq.Stream = stream
+
+	header := http.Header{}
+	header.Set("x-api-key", c.accessToken)
+	header.Set("anthropic-version", c.apiVersion)
+	return postProviderJSON(ctx, c.apiUrl+"/messages", header, areq, decodeAnthropicError)
+}
+
+func decodeAnthropicError(statusCode int, data []byte) error {
+	aerr := &anthropicError{}
+	if json.Unmarshal(data, aerr) != nil || aerr.Error.Message == "" {
+		return newProviderError(statusCode, "", strings.TrimSpace(string(data)))
+	}
+	return newProviderError(statusCode, aerr.Error.Type, aerr.Error.Message)
+}
+
+// newAnthropicRequest converts the request. The system messages become the
+// system prompt, and the tool results are sent back as user messages.
+func newAnthropicRequest(req openai.ChatCompletionRequest) (*anthropicRequest, error) {
+	areq := &anthropicRequest{}
+	areq.Model = req.Model
+	areq.MaxTokens = req.MaxTokens
+	if areq.MaxTokens <= 0 {
+		areq.MaxTokens = anthropicDefaultMaxTokens
+	}
+	areq.Temperature = min(req.Temperature, anthropicMaxTemperature)
+	areq.TopP = req.TopP
+	areq.StopSequences = req.Stop
+
+	for _, tool := range req.Tools {
+		if tool.Function == nil {
+			continue
+		}
+		areq.Tools = append(areq.Tools, anthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: tool.Function.Parameters,
+		})
+	}
+
+	systems := make([]string, 0)
+	for _, msg := range req.Messages {
+		role := openai.ChatMessageRoleUser
+		contents := make([]*anthropicContent, 0)
+		switch msg.Role {
+		case openai.ChatMessageRoleSystem:
+			systems = append(systems, messageText(&msg))
+			continue
+		case openai.ChatMessageRoleTool:
+			contents = append(contents, &anthropicContent{Type: "tool_result", ToolUseID: msg.ToolCallID, Content: msg.Content})
+		case openai.ChatMessageRoleAssistant:
+			role = "assistant"
+			if msg.Content != "" {
+				contents = append(contents, &anthropicContent{Type: "text", Text: msg.Content})
+			}
+			for _, call := range msg.ToolCalls {
+				input := json.RawMessage(call.Function.Arguments)
+				if strings.TrimSpace(call.Function.Arguments) == "" {
+					input = json.RawMessage("{}")
+				}
+				contents = append(contents, &anthropicContent{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+			}
+		default:
+			if msg.Content != "" {
+				contents = append(contents, &anthropicContent{Type: "text", Text: msg.Content})
+			}
+			for _, part := range msg.MultiContent {
+				switch part.Type {
+				case openai.ChatMessagePartTypeText:
+					if part.Text != "" {
+						contents = append(contents, &anthropicContent{Type: "text", Text: part.Text})
+					}
+				case openai.ChatMessagePartTypeImageURL:
+					source, err := newAnthropicImageSource(part.ImageURL.URL)
+					if err != nil {
+						return nil, errors.ErrorAt(err)
+					}
+					contents = append(contents, &anthropicContent{Type: "image", Source: source})
+				}
+			}
+		}
+
+		if len(contents) == 0 {
+			continue
+		}
+		// the roles must alternate, merge the consecutive messages of the same role
+		if last := len(areq.Messages) - 1; last >= 0 && areq.Messages[last].Role == role {
+			areq.Messages[last].Content = append(areq.Messages[last].Content, contents...)
+			continue
+		}
+		areq.Messages = append(areq.Messages, anthropicMessage{Role: role, Content: contents})
+	}
+	areq.System = strings.Join(systems, "\n\n")
+
+	return areq, nil
+}
+
+func newAnthropicImageSource(url string) (*anthropicImageSource, error) {
+	if !strings.HasPrefix(url, "data:") {
+		return &anthropicImageSource{Type: "url", Url: url}, nil
+	}
+
+	meta, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	mediaType, isBase64 := strings.CutSuffix(meta, ";base64")
+	if !ok || !isBase64 {
+		return nil, errors.Errorf("unsupported image url: %.32s", url)
+	}
+	return &anthropicImageSource{Type: "base64", MediaType: mediaType, Data: data}, nil
+}
+
+func anthropicFinishReason(stopReason string) openai.FinishReason {
+	switch stopReason {
+	case "end_turn", "stop_sequence":
+		return openai.FinishReasonStop
+	case "max_tokens":
+		return openai.FinishReasonLength
+	case "tool_use":
+		return openai.FinishReasonToolCalls
+	}
+	return openai.FinishReason(stopReason)
+}
+
+// anthropicStream reads the server-sent events and returns the text deltas.
+type anthropicStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
+
+type anthropicStreamEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	anthropicError
+}
+
+func (s *anthropicStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return openai.ChatCompletionStreamResponse{}, io.EOF
+			}
+			return openai.ChatCompletionStreamResponse{}, errors.ErrorAt(err)
+		}
+
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:")
+		if !ok {
+			continue
+		}
+
+		ev := &anthropicStreamEvent{}
+		err = json.Unmarshal([]byte(data), ev)
+		if err != nil {
+			return openai.ChatCompletionStreamResponse{}, errors.ErrorAtf(err, "invalid event: %s", data)
+		}
+
+		switch ev.Type {
+		case "content_block_delta":
+			if ev.Delta.Type != "text_delta" {
+				continue
+			}
+			return openai.ChatCompletionStreamResponse{
+				Choices: []openai.ChatCompletionStreamChoice{{
+					Delta: openai.ChatCompletionStreamChoiceDelta{Content: ev.Delta.Text},
+				}},
+			}, nil
+		case "message_delta":
+			if ev.Delta.StopReason == "" {
+				continue
+			}
+			return openai.ChatCompletionStreamResponse{
+				Choices: []openai.ChatCompletionStreamChoice{{
+					FinishReason: anthropicFinishReason(ev.Delta.StopReason),
+				}},
+			}, nil
+		case "message_stop":
+			return openai.ChatCompletionStreamResponse{}, io.EOF
+		case "error":
+			return openai.ChatCompletionStreamResponse{}, newProviderError(http.StatusOK, ev.Error.Type, ev.Error.Message)
+		}
+	}
+}
+
+func (s *anthropicStream) Close() error {
+	return s.body.Close()
+}
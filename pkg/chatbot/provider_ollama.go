@@ -0,0 +1,256 @@
+package chatbot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+)
+
+const ollamaDefaultApiUrl = "http://localhost:11434"
+
+// ollamaChatCompleter talks to the native chat API of Ollama.
+type ollamaChatCompleter struct {
+	apiUrl string
+}
+
+func newOllamaChatCompleter(p *cfgs.Provider) *ollamaChatCompleter {
+	c := &ollamaChatCompleter{}
+	c.apiUrl = strings.TrimSuffix(p.ApiUrl, "/")
+	if c.apiUrl == "" {
+		c.apiUrl = ollamaDefaultApiUrl
+	}
+	return c
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []openai.Tool   `json:"tools,omitempty"`
+	Format   string          `json:"format,omitempty"`
+	Options  map[string]any  `json:"options,omitempty"`
+	Stream   bool            `json:"stream"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+func (c *ollamaChatCompleter) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	resp, err := c.post(ctx, req, false)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	oresp := &ollamaResponse{}
+	err = json.NewDecoder(resp.Body).Decode(oresp)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, errors.ErrorAt(err)
+	}
+
+	msg := openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: oresp.Message.Content,
+	}
+	finishReason := ollamaFinishReason(oresp.DoneReason)
+	// Ollama does not identify the tool calls
+	for i, call := range oresp.Message.ToolCalls {
+		msg.ToolCalls = append(msg.ToolCalls, openai.ToolCall{
+			ID:   fmt.Sprintf("call_%d", i),
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      call.Function.Name,
+				Arguments: string(call.Function.Arguments),
+			},
+		})
+		finishReason = openai.FinishReasonToolCalls
+	}
+
+	return openai.ChatCompletionResponse{
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   oresp.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      msg,
+			FinishReason: finishReason,
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     oresp.PromptEvalCount,
+			CompletionTokens: oresp.EvalCount,
+			TotalTokens:      oresp.PromptEvalCount + oresp.EvalCount,
+		},
+	}, nil
+}
+
+func (c *ollamaChatCompleter) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatCompletionStream, error) {
+	resp, err := c.post(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	return &ollamaStream{body: resp.Body, reader: bufio.NewReader(resp.Body)}, nil
+}
+
+func (c *ollamaChatCompleter) post(ctx context.Context, req openai.ChatCompletionRequest, stream bool) (*http.Response, error) {
+	oreq := newOllamaRequest(req)
+	oreq.Stream = stream
+	return postProviderJSON(ctx, c.apiUrl+"/api/chat", nil, oreq, decodeOllamaError)
+}
+
+func decodeOllamaError(statusCode int, data []byte) error {
+	oresp := &ollamaResponse{}
+	if json.Unmarshal(data, oresp) != nil || oresp.Error == "" {
+		return newProviderError(statusCode, "", strings.TrimSpace(string(data)))
+	}
+	return newProviderError(statusCode, "", oresp.Error)
+}
+
+func newOllamaRequest(req openai.ChatCompletionRequest) *ollamaRequest {
+	oreq := &ollamaRequest{}
+	oreq.Model = req.Model
+	oreq.Tools = req.Tools
+	if req.ResponseFormat != nil && req.ResponseFormat.Type == openai.ChatCompletionResponseFormatTypeJSONObject {
+		oreq.Format = "json"
+	}
+
+	oreq.Options = map[string]any{}
+	if req.Temperature != 0 {
+		oreq.Options["temperature"] = req.Temperature
+	}
+	if req.TopP != 0 {
+		oreq.Options["top_p"] = req.TopP
+	}
+	if req.MaxTokens > 0 {
+		oreq.Options["num_predict"] = req.MaxTokens
+	}
+	if req.PresencePenalty != 0 {
+		oreq.Options["presence_penalty"] = req.PresencePenalty
+	}
+	if req.FrequencyPenalty != 0 {
+		oreq.Options["frequency_penalty"] = req.FrequencyPenalty
+	}
+	if len(req.Stop) != 0 {
+		oreq.Options["stop"] = req.Stop
+	}
+
+	for _, msg := range req.Messages {
+		omsg := ollamaMessage{Role: msg.Role, Content: msg.Content}
+		texts := make([]string, 0, len(msg.MultiContent))
+		for _, part := range msg.MultiContent {
+			switch part.Type {
+			case openai.ChatMessagePartTypeText:
+				texts = append(texts, part.Text)
+			case openai.ChatMessagePartTypeImageURL:
+				// Ollama only accepts the base64 data of images
+				_, data, ok := strings.Cut(part.ImageURL.URL, ";base64,")
+				if !ok {
+					log.Warnf("ollama skips the image which is not a data url")
+					continue
+				}
+				omsg.Images = append(omsg.Images, data)
+			}
+		}
+		if len(texts) != 0 {
+			omsg.Content = strings.Join(texts, "\n")
+		}
+		for _, call := range msg.ToolCalls {
+			ocall := ollamaToolCall{}
+			ocall.Function.Name = call.Function.Name
+			ocall.Function.Arguments = json.RawMessage(call.Function.Arguments)
+			if strings.TrimSpace(call.Function.Arguments) == "" {
+				ocall.Function.Arguments = json.RawMessage("{}")
+			}
+			omsg.ToolCalls = append(omsg.ToolCalls, ocall)
+		}
+		oreq.Messages = append(oreq.Messages, omsg)
+	}
+
+	return oreq
+}
+
+func ollamaFinishReason(doneReason string) openai.FinishReason {
+	switch doneReason {
+	case "", "stop":
+		return openai.FinishReasonStop
+	case "length":
+		return openai.FinishReasonLength
+	}
+	return openai.FinishReason(doneReason)
+}
+
+// ollamaStream reads the answer from the lines of json.
+type ollamaStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	done   bool
+}
+
+func (s *ollamaStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	for !s.done {
+		line, err := s.reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) == 0 {
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return openai.ChatCompletionStreamResponse{}, io.EOF
+				}
+				return openai.ChatCompletionStreamResponse{}, errors.ErrorAt(err)
+			}
+			continue
+		}
+
+		oresp := &ollamaResponse{}
+		err = json.Unmarshal(line, oresp)
+		if err != nil {
+			return openai.ChatCompletionStreamResponse{}, errors.ErrorAtf(err, "invalid chunk: %s", line)
+		}
+		if oresp.Error != "" {
+			return openai.ChatCompletionStreamResponse{}, newProviderError(http.StatusOK, "", oresp.Error)
+		}
+
+		choice := openai.ChatCompletionStreamChoice{}
+		choice.Delta.Content = oresp.Message.Content
+		if oresp.Done {
+			s.done = true
+			choice.FinishReason = ollamaFinishReason(oresp.DoneReason)
+		}
+		return openai.ChatCompletionStreamResponse{
+			Model:   oresp.Model,
+			Choices: []openai.ChatCompletionStreamChoice{choice},
+		}, nil
+	}
+
+	return openai.ChatCompletionStreamResponse{}, io.EOF
+}
+
+func (s *ollamaStream) Close() error {
+	return s.body.Close()
+}
@@ -0,0 +1,196 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProviderServer(t *testing.T, handler http.HandlerFunc) string {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestBot_chatRoute(t *testing.T) {
+	cfg := &cfgs.Config{
+		ChatGptModel: "gpt-3.5-turbo",
+		Providers: map[string]*cfgs.Provider{
+			"claude": {Type: cfgs.ProviderAnthropic, Model: "claude-3-5-sonnet"},
+			"local":  {Type: cfgs.ProviderOllama},
+		},
+		Bots: map[string]*cfgs.Bot{
+			"/linebot":  {Provider: "local", Model: "llama3"},
+			"/telegram": {Model: "gpt-4o"},
+		},
+	}
+	providers, err := newChatCompleters(cfg)
+	assert.NoError(t, err)
+	bot := &Bot{providers: providers}
+	bot.cfg.Store(cfg)
+
+	cases := []struct {
+		botPath  string
+		role     *cfgs.Role
+		provider string
+		model    string
+	}{
+		{"/other", &cfgs.Role{}, cfgs.DefaultProvider, "gpt-3.5-turbo"},
+		{"/telegram", &cfgs.Role{}, cfgs.DefaultProvider, "gpt-4o"},
+		{"/linebot", &cfgs.Role{}, "local", "llama3"},
+		{"/linebot", &cfgs.Role{Model: "qwen2"}, "local", "qwen2"},
+		{"/linebot", &cfgs.Role{Provider: "claude"}, "claude", "claude-3-5-sonnet"},
+	}
+	for _, c := range cases {
+		route, err := bot.chatRoute(c.botPath, c.role)
+		assert.NoError(t, err)
+		assert.Equal(t, c.provider, route.provider, c.botPath)
+		assert.Same(t, providers[c.provider], route.completer, c.botPath)
+		assert.Equal(t, c.model, route.model, c.botPath)
+	}
+
+	_, err = bot.chatRoute("/linebot", &cfgs.Role{Provider: "unknown"})
+	assert.Error(t, err)
+}
+
+func TestAnthropicChatCompleter(t *testing.T) {
+	url := newTestProviderServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/messages", r.URL.Path)
+		assert.Equal(t, "key", r.Header.Get("x-api-key"))
+		assert.Equal(t, anthropicDefaultApiVersion, r.Header.Get("anthropic-version"))
+
+		areq := &anthropicRequest{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(areq))
+		assert.Equal(t, "prompt\n\nsummary", areq.System)
+		assert.Equal(t, anthropicDefaultMaxTokens, areq.MaxTokens)
+		assert.Equal(t, float32(1), areq.Temperature)
+		if assert.Len(t, areq.Messages, 3) {
+			assert.Equal(t, "user", areq.Messages[0].Role)
+			assert.Equal(t, "image", areq.Messages[0].Content[1].Type)
+			assert.Equal(t, "image/png", areq.Messages[0].Content[1].Source.MediaType)
+			assert.Equal(t, "tool_use", areq.Messages[1].Content[0].Type)
+			// the tool result and the next question are merged
+			assert.Equal(t, "tool_result", areq.Messages[2].Content[0].Type)
+			assert.Equal(t, "text", areq.Messages[2].Content[1].Type)
+		}
+
+		if areq.Stream {
+			for _, text := range []string{"你", "好"} {
+				fmt.Fprintf(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"%s\"}}\n\n", text)
+			}
+			fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+			return
+		}
+		if areq.Model == "overloaded" {
+			w.WriteHeader(529)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"msg_1","model":"claude","content":[{"type":"text","text":"你好"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":2}}`)
+	})
+
+	completer, err := newChatCompleter(&cfgs.Provider{Type: cfgs.ProviderAnthropic, ApiUrl: url, AccessToken: "key"})
+	assert.NoError(t, err)
+
+	req := openai.ChatCompletionRequest{
+		Model:       "claude",
+		Temperature: 1.2,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: "prompt"},
+			{Role: openai.ChatMessageRoleSystem, Content: "summary"},
+			*newImageMessage(openai.ChatMessageRoleUser, "幾點了", []string{"data:image/png;base64,AAAA"}),
+			{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "current_time"}}}},
+			{Role: openai.ChatMessageRoleTool, ToolCallID: "call_1", Content: "12:00"},
+			{Role: openai.ChatMessageRoleUser, Content: "謝謝"},
+		},
+	}
+
+	resp, err := completer.CreateChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "你好", resp.Choices[0].Message.Content)
+	assert.Equal(t, openai.FinishReasonStop, resp.Choices[0].FinishReason)
+	assert.Equal(t, 12, resp.Usage.TotalTokens)
+
+	stream, err := completer.CreateChatCompletionStream(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "你好", readTestStream(t, stream))
+
+	req.Model = "overloaded"
+	_, err = completer.CreateChatCompletion(context.Background(), req)
+	assert.Equal(t, http.StatusInternalServerError, GetOpenAIErrCode(err))
+}
+
+func TestOllamaChatCompleter(t *testing.T) {
+	url := newTestProviderServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/chat", r.URL.Path)
+
+		oreq := &ollamaRequest{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(oreq))
+		if oreq.Model == "missing" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"unauthorized"}`)
+			return
+		}
+		assert.Equal(t, []string{"AAAA"}, oreq.Messages[0].Images)
+		assert.Equal(t, "這是什麼", oreq.Messages[0].Content)
+
+		if oreq.Stream {
+			fmt.Fprint(w, `{"model":"llava","message":{"role":"assistant","content":"一隻"},"done":false}`+"\n")
+			fmt.Fprint(w, `{"model":"llava","message":{"role":"assistant","content":"貓"},"done":false}`+"\n")
+			fmt.Fprint(w, `{"model":"llava","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop"}`+"\n")
+			return
+		}
+		fmt.Fprint(w, `{"model":"llava","message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"draw_image","arguments":{"prompt":"cat"}}}]},"done":true}`)
+	})
+
+	completer, err := newChatCompleter(&cfgs.Provider{Type: cfgs.ProviderOllama, ApiUrl: url})
+	assert.NoError(t, err)
+
+	req := openai.ChatCompletionRequest{
+		Model:    "llava",
+		Messages: []openai.ChatCompletionMessage{*newImageMessage(openai.ChatMessageRoleUser, "這是什麼", []string{"data:image/png;base64,AAAA"})},
+	}
+
+	resp, err := completer.CreateChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+	if assert.Len(t, resp.Choices[0].Message.ToolCalls, 1) {
+		assert.Equal(t, "draw_image", resp.Choices[0].Message.ToolCalls[0].Function.Name)
+		assert.JSONEq(t, `{"prompt":"cat"}`, resp.Choices[0].Message.ToolCalls[0].Function.Arguments)
+	}
+	assert.Equal(t, openai.FinishReasonToolCalls, resp.Choices[0].FinishReason)
+
+	stream, err := completer.CreateChatCompletionStream(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "一隻貓", readTestStream(t, stream))
+
+	req.Model = "missing"
+	_, err = completer.CreateChatCompletion(context.Background(), req)
+	assert.Equal(t, http.StatusUnauthorized, GetOpenAIErrCode(err))
+}
+
+func readTestStream(t *testing.T, stream ChatCompletionStream) string {
+	defer stream.Close()
+	sb := &strings.Builder{}
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return sb.String()
+		}
+		if !assert.NoError(t, err) {
+			return sb.String()
+		}
+		if len(resp.Choices) != 0 {
+			sb.WriteString(resp.Choices[0].Delta.Content)
+		}
+	}
+}
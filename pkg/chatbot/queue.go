@@ -0,0 +1,238 @@
+package chatbot
+
+import (
+	"sync"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+)
+
+// TaskQueue keeps a FIFO of tasks for each session. Pop never hands out a task
+// whose session still has a running task, so tasks of the same session are
+// executed in order while different sessions run in parallel.
+type TaskQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	cap      int
+	size     int
+	pending  map[string][]Task
+	ready    []string
+	running  map[string]bool
+	paused   bool
+	draining bool
+	closed   bool
+
+	// counters of the overloads
+	rejected  int
+	dropped   int
+	coalesced int
+}
+
+func NewTaskQueue(cap int) *TaskQueue {
+	q := &TaskQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	q.cap = cap
+	q.pending = make(map[string][]Task)
+	q.running = make(map[string]bool)
+	return q
+}
+
+// PushResult is the result of TryPush.
+type PushResult int
+
+const (
+	PushOK PushResult = iota
+	// PushCoalesced means the task is merged into the last waiting task of the session.
+	PushCoalesced
+	// PushDroppedOldest means the oldest waiting task of the session is dropped.
+	PushDroppedOldest
+	// PushFull means the task is rejected since the queue is full.
+	PushFull
+	// PushClosed means the task is rejected since the queue is draining or closed.
+	PushClosed
+)
+
+// coalescer is the task which can absorb the next task of its session, e.g.
+// the consecutive messages.
+type coalescer interface {
+	coalesce(bot *Bot, next Task) bool
+}
+
+// TryPush pushes the task without blocking. When the queue is full, the policy
+// decides: cfgs.OverloadDropOldest drops the oldest waiting task of the
+// session and returns it, cfgs.OverloadCoalesce merges the task into the last
+// waiting task of the session. If the policy does not apply, e.g. no task of
+// the session is waiting, the task is rejected.
+func (q *TaskQueue) TryPush(bot *Bot, task Task, policy string) (PushResult, Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.draining {
+		return PushClosed, nil
+	}
+
+	id := task.SessionID()
+	if q.cap > 0 && q.size >= q.cap {
+		pending := q.pending[id]
+		switch {
+		case policy == cfgs.OverloadDropOldest && len(pending) != 0:
+			dropped := pending[0]
+			q.pending[id] = append(pending[1:], task)
+			q.dropped++
+			return PushDroppedOldest, dropped
+		case policy == cfgs.OverloadCoalesce && len(pending) != 0:
+			if last, ok := pending[len(pending)-1].(coalescer); ok && last.coalesce(bot, task) {
+				q.coalesced++
+				return PushCoalesced, nil
+			}
+		}
+		q.rejected++
+		return PushFull, nil
+	}
+
+	if len(q.pending[id]) == 0 && !q.running[id] {
+		q.ready = append(q.ready, id)
+	}
+	q.pending[id] = append(q.pending[id], task)
+	q.size++
+	q.cond.Broadcast()
+	return PushOK, nil
+}
+
+// Pop blocks until a task is ready. It returns false if the queue is closed.
+// Done must be called after the task is finished.
+func (q *TaskQueue) Pop() (Task, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for !q.closed && (q.paused || len(q.ready) == 0) {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+
+	id := q.ready[0]
+	q.ready = q.ready[1:]
+	tasks := q.pending[id]
+	task := tasks[0]
+	if len(tasks) == 1 {
+		delete(q.pending, id)
+	} else {
+		q.pending[id] = tasks[1:]
+	}
+	q.running[id] = true
+	q.size--
+	q.cond.Broadcast()
+	return task, true
+}
+
+func (q *TaskQueue) Done(task Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id := task.SessionID()
+	delete(q.running, id)
+	if len(q.pending[id]) != 0 {
+		q.ready = append(q.ready, id)
+	}
+	q.cond.Broadcast()
+}
+
+// WaitIdle blocks until no task is waiting or running. It returns at once if
+// the queue is closed.
+func (q *TaskQueue) WaitIdle() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for !q.closed && (q.size != 0 || len(q.running) != 0) {
+		q.cond.Wait()
+	}
+}
+
+// Pause stops handing out tasks and waits until the running tasks are done.
+// The tasks can still be pushed while the queue is paused.
+func (q *TaskQueue) Pause() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.paused = true
+	for !q.closed && len(q.running) != 0 {
+		q.cond.Wait()
+	}
+}
+
+func (q *TaskQueue) Resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = false
+	q.cond.Broadcast()
+}
+
+// Len returns the number of tasks waiting in the queue.
+func (q *TaskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// QueueStats is the depth of the task queue and the counters of the overloads.
+type QueueStats struct {
+	Waiting  int `json:"waiting"`
+	Running  int `json:"running"`
+	Capacity int `json:"capacity"`
+	// Sessions are the numbers of the waiting tasks of the sessions.
+	Sessions  map[string]int `json:"sessions"`
+	Rejected  int            `json:"rejected"`
+	Dropped   int            `json:"dropped"`
+	Coalesced int            `json:"coalesced"`
+}
+
+func (q *TaskQueue) Stats() *QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := &QueueStats{
+		Waiting:   q.size,
+		Running:   len(q.running),
+		Capacity:  q.cap,
+		Sessions:  make(map[string]int, len(q.pending)),
+		Rejected:  q.rejected,
+		Dropped:   q.dropped,
+		Coalesced: q.coalesced,
+	}
+	for id, tasks := range q.pending {
+		stats.Sessions[id] = len(tasks)
+	}
+	return stats
+}
+
+// Drain rejects the new tasks, while the waiting tasks are still handed out.
+func (q *TaskQueue) Drain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.draining = true
+	q.cond.Broadcast()
+}
+
+// Close wakes up the blocked calls, and returns the tasks which are still
+// waiting in the queue.
+func (q *TaskQueue) Close() []Task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+
+	tasks := make([]Task, 0, q.size)
+	for _, id := range q.ready {
+		tasks = append(tasks, q.pending[id]...)
+		delete(q.pending, id)
+	}
+	// the sessions which are running are not ready
+	for _, pending := range q.pending {
+		tasks = append(tasks, pending...)
+	}
+	q.pending = make(map[string][]Task)
+	q.ready = nil
+	q.size = 0
+	return tasks
+}
@@ -0,0 +1,195 @@
+package chatbot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTask struct {
+	id  string
+	seq int
+}
+
+func (task *testTask) Do(bot *Bot) error { return nil }
+func (task *testTask) SessionID() string { return task.id }
+
+// pushTask pushes the task of the tests, which do not fill the queue.
+func pushTask(q *TaskQueue, task Task) PushResult {
+	result, _ := q.TryPush(nil, task, cfgs.OverloadBusy)
+	return result
+}
+
+func TestTaskQueue(t *testing.T) {
+	q := NewTaskQueue(0)
+	pushTask(q, &testTask{id: "a", seq: 1})
+	pushTask(q, &testTask{id: "a", seq: 2})
+	pushTask(q, &testTask{id: "b", seq: 1})
+	assert.Equal(t, 3, q.Len())
+
+	task1, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, &testTask{id: "a", seq: 1}, task1)
+
+	// session a is running, so the next task must come from session b
+	task2, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, &testTask{id: "b", seq: 1}, task2)
+
+	q.Done(task1)
+	task3, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, &testTask{id: "a", seq: 2}, task3)
+	assert.Equal(t, 0, q.Len())
+
+	q.Close()
+	_, ok = q.Pop()
+	assert.False(t, ok)
+	assert.Equal(t, PushClosed, pushTask(q, &testTask{id: "a"}))
+}
+
+func TestTaskQueuePause(t *testing.T) {
+	q := NewTaskQueue(0)
+	pushTask(q, &testTask{id: "a", seq: 1})
+	task1, _ := q.Pop()
+
+	paused := make(chan struct{})
+	go func() {
+		q.Pause()
+		close(paused)
+	}()
+
+	// Pause waits for the running task
+	select {
+	case <-paused:
+		t.Fatal("pause returns before the running task is done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.Done(task1)
+	<-paused
+
+	// no task is handed out while paused
+	pushTask(q, &testTask{id: "b", seq: 1})
+	popped := make(chan Task)
+	go func() {
+		task, _ := q.Pop()
+		popped <- task
+	}()
+	select {
+	case <-popped:
+		t.Fatal("pop returns while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Resume()
+	assert.Equal(t, &testTask{id: "b", seq: 1}, <-popped)
+}
+
+func TestTaskQueueDrain(t *testing.T) {
+	q := NewTaskQueue(0)
+	pushTask(q, &testTask{id: "a", seq: 1})
+	pushTask(q, &testTask{id: "a", seq: 2})
+	pushTask(q, &testTask{id: "b", seq: 1})
+	task1, _ := q.Pop()
+
+	// the new tasks are rejected, the waiting ones are still handed out
+	q.Drain()
+	assert.Equal(t, PushClosed, pushTask(q, &testTask{id: "c", seq: 1}))
+	task2, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, &testTask{id: "b", seq: 1}, task2)
+
+	// the task of the running session is returned by Close
+	q.Done(task1)
+	assert.Equal(t, []Task{&testTask{id: "a", seq: 2}}, q.Close())
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestTaskQueueTryPush(t *testing.T) {
+	q := NewTaskQueue(2)
+	result, _ := q.TryPush(nil, &testTask{id: "a", seq: 1}, cfgs.OverloadBusy)
+	assert.Equal(t, PushOK, result)
+	pushTask(q, &testTask{id: "a", seq: 2})
+
+	result, _ = q.TryPush(nil, &testTask{id: "a", seq: 3}, cfgs.OverloadBusy)
+	assert.Equal(t, PushFull, result)
+
+	result, dropped := q.TryPush(nil, &testTask{id: "a", seq: 3}, cfgs.OverloadDropOldest)
+	assert.Equal(t, PushDroppedOldest, result)
+	assert.Equal(t, &testTask{id: "a", seq: 1}, dropped)
+
+	// session b has no waiting task to drop
+	result, _ = q.TryPush(nil, &testTask{id: "b", seq: 1}, cfgs.OverloadDropOldest)
+	assert.Equal(t, PushFull, result)
+
+	stats := q.Stats()
+	assert.Equal(t, 2, stats.Waiting)
+	assert.Equal(t, map[string]int{"a": 2}, stats.Sessions)
+	assert.Equal(t, 2, stats.Rejected)
+	assert.Equal(t, 1, stats.Dropped)
+
+	task, _ := q.Pop()
+	assert.Equal(t, &testTask{id: "a", seq: 2}, task)
+}
+
+func TestTaskQueueTryPush_Coalesce(t *testing.T) {
+	bot, err := NewBot(newTestReloadConfig(t))
+	assert.NoError(t, err)
+	q := NewTaskQueue(1)
+	session := NewSession("a", "A")
+	ch1, ch2 := &funcChannel{}, &funcChannel{}
+	first := &ChatTask{Session: session, UserID: "U1", UserName: "Alice", Message: "hi", Channel: ch1}
+	q.TryPush(bot, first, cfgs.OverloadCoalesce)
+
+	// the user renamed
+	result, _ := q.TryPush(bot, &ChatTask{Session: session, UserID: "U1", UserName: "Alice2", Message: "are you there?", Channel: ch2}, cfgs.OverloadCoalesce)
+	assert.Equal(t, PushCoalesced, result)
+	assert.Equal(t, "hi\nare you there?", first.Message)
+	assert.Same(t, ch2, first.Channel)
+
+	// another user of the same name
+	result, _ = q.TryPush(bot, &ChatTask{Session: session, UserID: "U2", UserName: "Alice", Message: "hi"}, cfgs.OverloadCoalesce)
+	assert.Equal(t, PushFull, result)
+
+	result, _ = q.TryPush(bot, &ChatTask{Session: session, UserID: "U1", UserName: "Alice", Audio: &Attachment{}}, cfgs.OverloadCoalesce)
+	assert.Equal(t, PushFull, result)
+	assert.Equal(t, 1, q.Len())
+
+	// the messages in the groups talk to AI by the commands too, not only by the mentions
+	q = NewTaskQueue(1)
+	group := NewSession("g", "A")
+	first = &ChatTask{Session: group, UserID: "U1", Message: "@ai hi", IsGroup: true}
+	q.TryPush(bot, first, cfgs.OverloadCoalesce)
+	result, _ = q.TryPush(bot, &ChatTask{Session: group, UserID: "U1", Message: "hello", IsGroup: true}, cfgs.OverloadCoalesce)
+	assert.Equal(t, PushFull, result)
+	result, _ = q.TryPush(bot, &ChatTask{Session: group, UserID: "U1", Message: "more", IsGroup: true, Mentioned: true}, cfgs.OverloadCoalesce)
+	assert.Equal(t, PushCoalesced, result)
+	assert.Equal(t, "@ai hi\nmore", first.Message)
+}
+
+func TestBot_Dispatch_Busy(t *testing.T) {
+	cfg := newTestReloadConfig(t)
+	cfg.MaxTaskQueueCap = 1
+	bot, err := NewBot(cfg)
+	assert.NoError(t, err)
+
+	replies := make([]string, 0)
+	ch := &funcChannel{reply: func(reply *Reply) error {
+		replies = append(replies, reply.Text)
+		return nil
+	}}
+	assert.True(t, bot.Dispatch(&Event{BotPath: "/linebot", ConversationID: "U1", Text: "hi"}, ch))
+	// the webhook is not blocked by the full queue
+	assert.False(t, bot.Dispatch(&Event{BotPath: "/linebot", ConversationID: "U2", Text: "hi"}, ch))
+	assert.Equal(t, []string{"小愛現在太忙了，請稍後再說一次"}, replies)
+
+	// the chatter in the group is neither queued nor told that the bot is busy
+	group := &Event{BotPath: "/linebot", ConversationID: "G1", UserID: "U3", IsGroup: true, Text: "hello"}
+	assert.False(t, bot.Dispatch(group, ch))
+	assert.Len(t, replies, 1)
+	group.Text = "@ai hello"
+	assert.False(t, bot.Dispatch(group, ch))
+	assert.Len(t, replies, 2)
+}
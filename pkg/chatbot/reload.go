@@ -0,0 +1,268 @@
+package chatbot
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/sashabaranov/go-openai"
+)
+
+// reloadState is built from the new config before it is swapped in, so an
+// invalid config changes nothing.
+type reloadState struct {
+	messengers  map[string]Messenger
+	started     []string
+	stopped     []string
+	gptClient   *openai.Client
+	providers   map[string]ChatCompleter
+	audioClient *openai.Client
+	ttsClient   *openai.Client
+	imageClient *openai.Client
+}
+
+// Reload swaps in the new config without restarting the server. The messengers
+// are rebuilt only if their bots change, and the sessions keep their messages
+// unless their roles are removed. If the config is invalid, the old one is kept
+// and the diff is logged.
+func (bot *Bot) Reload(cfg *cfgs.Config) error {
+	bot.reloadMu.Lock()
+	defer bot.reloadMu.Unlock()
+
+	old := bot.getConfig()
+	if old.Equal(cfg) {
+		return nil
+	}
+	diff := diffConfig(old, cfg)
+	if diff == "" {
+		diff = "the secrets change"
+	}
+
+	state, err := bot.prepareReload(old, cfg)
+	if err != nil {
+		log.Errorf("reject the new config, keep the old one:\n%s", diff)
+		return errors.ErrorAt(err)
+	}
+	warnRestartRequired(old, cfg)
+
+	// wait for the running tasks, they use the clients and the providers
+	// without the lock, the config is swapped atomically for the handlers
+	bot.taskQueue.Pause()
+	defer bot.taskQueue.Resume()
+
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+
+	bot.cfg.Store(cfg)
+	bot.gptClient = state.gptClient
+	bot.providers = state.providers
+	// keep the open circuits unless the breaker changes
+	if cfg.CircuitBreakThreshold != old.CircuitBreakThreshold || cfg.CircuitBreakCooldown != old.CircuitBreakCooldown {
+		bot.breaker = newCircuitBreaker(cfg.CircuitBreakThreshold, cfg.CircuitBreakCooldown)
+	}
+	bot.audioClient = state.audioClient
+	bot.ttsClient = state.ttsClient
+	bot.imageClient = state.imageClient
+
+	bot.messengers = state.messengers
+	bot.handler.Store(bot.newHandler(state.messengers))
+	for _, path := range state.stopped {
+		if stop, ok := bot.messengerStops[path]; ok {
+			close(stop)
+			delete(bot.messengerStops, path)
+		}
+	}
+	if bot.serving {
+		for _, path := range state.started {
+			bot.runMessenger(path, state.messengers[path])
+		}
+	}
+
+	ids := bot.sessMgr.ResetMissingRoles(cfg.Roles, func(id string) string {
+		return bot.defaultRole(botPathOfSession(cfg, id))
+	})
+	if len(ids) != 0 {
+		log.Infof("reset the sessions of the removed roles: %v", ids)
+	}
+
+	log.Infof("reload the config:\n%s", diff)
+	return nil
+}
+
+// getConfig returns the current config, a request or a task reads it once so
+// it sees a single config even if Reload swaps it meanwhile.
+func (bot *Bot) getConfig() *cfgs.Config {
+	return bot.cfg.Load()
+}
+
+func (bot *Bot) prepareReload(old, cfg *cfgs.Config) (*reloadState, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	state := &reloadState{}
+	state.providers, err = newChatCompleters(cfg)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	state.gptClient = newGptClient(cfg, cfg.ChatGptApiUrl)
+	state.audioClient = newGptClientIfUrl(cfg, state.gptClient, cfg.TranscriptionApiUrl)
+	state.ttsClient = newGptClientIfUrl(cfg, state.gptClient, cfg.TtsApiUrl)
+	state.imageClient = newGptClientIfUrl(cfg, state.gptClient, cfg.ImageApiUrl)
+
+	state.messengers = make(map[string]Messenger, len(cfg.Bots))
+	for path, botcfg := range cfg.Bots {
+		if oldcfg, ok := old.Bots[path]; ok && sameMessenger(oldcfg, botcfg) {
+			state.messengers[path] = bot.messengers[path]
+			continue
+		}
+
+		// e.g. the credentials of the bot change
+		messenger, err := newMessenger(bot, path, botcfg)
+		if err != nil {
+			return nil, errors.ErrorAt(err)
+		}
+		state.messengers[path] = messenger
+		state.started = append(state.started, path)
+		if _, ok := old.Bots[path]; ok {
+			state.stopped = append(state.stopped, path)
+		}
+	}
+	for path := range old.Bots {
+		if _, ok := cfg.Bots[path]; !ok {
+			state.stopped = append(state.stopped, path)
+		}
+	}
+
+	return state, nil
+}
+
+// sameMessenger reports whether the messenger of the bot can be kept, the
+// limits are read by the tasks.
+func sameMessenger(old, cfg *cfgs.Bot) bool {
+	a, b := *old, *cfg
+	a.RateLimit, b.RateLimit = nil, nil
+	return a == b
+}
+
+// warnRestartRequired warns the settings which take effect after restart.
+func warnRestartRequired(old, cfg *cfgs.Config) {
+	settings := map[string][2]any{
+		"ServePort":            {old.ServePort, cfg.ServePort},
+		"LogPath":              {old.LogPath, cfg.LogPath},
+		"DebugMode":            {old.DebugMode, cfg.DebugMode},
+		"SessionStore":         {old.SessionStore, cfg.SessionStore},
+		"SessionClearInterval": {old.SessionClearInterval, cfg.SessionClearInterval},
+		"MaxTaskQueueCap":      {old.MaxTaskQueueCap, cfg.MaxTaskQueueCap},
+		"TaskWorkerCount":      {old.TaskWorkerCount, cfg.TaskWorkerCount},
+	}
+	for name, values := range settings {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			log.Warnf("%s changes from %v to %v, it takes effect after restart", name, values[0], values[1])
+		}
+	}
+}
+
+// botPathOfSession returns the path of the bot which the session belongs to.
+func botPathOfSession(cfg *cfgs.Config, id string) string {
+	if strings.HasPrefix(id, apiBotPath+"/") {
+		return apiBotPath
+	}
+
+	botPath := ""
+	for path := range cfg.Bots {
+		if strings.HasPrefix(id, path+"/") && len(path) > len(botPath) {
+			botPath = path
+		}
+	}
+	return botPath
+}
+
+// diffConfig returns the unified diff of the configs in yaml with the secrets
+// masked, empty if they are the same.
+func diffConfig(old, cfg *cfgs.Config) string {
+	a, b := &bytes.Buffer{}, &bytes.Buffer{}
+	old.WriteConfig(a)
+	cfg.WriteConfig(b)
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(a.String()),
+		B:        difflib.SplitLines(b.String()),
+		FromFile: "old",
+		ToFile:   "new",
+		Context:  2,
+	})
+	if err != nil {
+		log.ErrorAt(err)
+	}
+	return diff
+}
+
+// WatchConfig polls the config file and the roles file, and reloads the config
+// when they change. override applies the settings which are not in the files,
+// e.g. the command-line flags, it can be nil. It returns when the bot stops or
+// ConfigWatchInterval is not positive.
+func (bot *Bot) WatchConfig(fname string, override func(cfg *cfgs.Config)) {
+	stamps := bot.configFileStamps(fname)
+	for {
+		interval := bot.getConfig().ConfigWatchInterval
+		if interval <= 0 {
+			return
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-bot.stop:
+			return
+		}
+
+		newStamps := bot.configFileStamps(fname)
+		if reflect.DeepEqual(stamps, newStamps) {
+			continue
+		}
+		stamps = newStamps
+
+		log.Infof("config changed, reload %s", fname)
+		cfg, err := cfgs.Load(fname)
+		if err != nil {
+			log.Errorf("unable to load the config, keep the old one: %s", errors.GetErrorDetails(err))
+			continue
+		}
+		if override != nil {
+			override(cfg)
+		}
+		err = bot.Reload(cfg)
+		if err != nil {
+			log.Errorf("unable to reload the config: %s", errors.GetErrorDetails(err))
+		}
+	}
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func (bot *Bot) configFileStamps(fname string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, 2)
+	fnames := []string{fname}
+	if rolesFile := bot.getConfig().GetRolesFile(fname); rolesFile != "" {
+		fnames = append(fnames, rolesFile)
+	}
+	for _, fname := range fnames {
+		info, err := os.Stat(fname)
+		if err != nil {
+			stamps[fname] = fileStamp{}
+			continue
+		}
+		stamps[fname] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps
+}
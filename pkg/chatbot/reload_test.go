@@ -0,0 +1,127 @@
+package chatbot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReloadConfig(t *testing.T) *cfgs.Config {
+	cfg := cfgs.DefaultConfig()
+	cfg.Bots = nil
+	cfg.LogPath = t.TempDir()
+	cfg.Roles = cfgs.Roles{
+		"A": &cfgs.Role{Prompt: "a"},
+		"B": &cfgs.Role{Prompt: "b"},
+	}
+	return cfg
+}
+
+func TestBot_Reload(t *testing.T) {
+	server := httptest.NewServer(&fakeTelegramServer{})
+	defer server.Close()
+
+	cfg := newTestReloadConfig(t)
+	bot, err := NewBot(cfg)
+	assert.NoError(t, err)
+
+	post := func() int {
+		w := httptest.NewRecorder()
+		bot.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/telegram", strings.NewReader("{}")))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNotFound, post())
+
+	msg := &openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "hi"}
+	sessA := bot.sessMgr.GetSession("/telegram/1", "A")
+	sessA.AddMessage(msg)
+	sessB := bot.sessMgr.GetSession("/telegram/2", "B")
+	sessB.AddMessage(msg)
+
+	// the role of the bot is removed
+	invalid := newTestReloadConfig(t)
+	invalid.Bots = map[string]*cfgs.Bot{
+		"/telegram": {Platform: cfgs.PlatformTelegram, DefaultRole: "C", TelegramToken: "token", TelegramApiUrl: server.URL},
+	}
+	assert.Error(t, bot.Reload(invalid))
+	assert.Same(t, cfg, bot.getConfig())
+	assert.Equal(t, http.StatusNotFound, post())
+
+	newCfg := newTestReloadConfig(t)
+	delete(newCfg.Roles, "A")
+	newCfg.Bots = map[string]*cfgs.Bot{
+		"/telegram": {Platform: cfgs.PlatformTelegram, DefaultRole: "B", TelegramToken: "token", TelegramApiUrl: server.URL},
+	}
+	assert.NoError(t, bot.Reload(newCfg))
+	assert.Same(t, newCfg, bot.getConfig())
+	assert.Contains(t, bot.messengers, "/telegram")
+	assert.NotEqual(t, http.StatusNotFound, post())
+
+	// the session of the removed role is reset, the others are kept
+	assert.Equal(t, "B", sessA.GetRole())
+	assert.Equal(t, 0, sessA.Len())
+	assert.Equal(t, 1, sessB.Len())
+
+	// the messenger is kept if the bot does not change
+	messenger := bot.messengers["/telegram"]
+	newCfg2 := newTestReloadConfig(t)
+	newCfg2.Bots = newCfg.Bots
+	newCfg2.ChatGptModel = "gpt-4o"
+	assert.NoError(t, bot.Reload(newCfg2))
+	assert.Same(t, messenger, bot.messengers["/telegram"])
+}
+
+func TestBot_Reload_Breaker(t *testing.T) {
+	cfg := newTestReloadConfig(t)
+	bot, err := NewBot(cfg)
+	assert.NoError(t, err)
+	name := cfgs.DefaultProvider + "/gpt-4o"
+	for i := 0; i < cfg.CircuitBreakThreshold; i++ {
+		bot.breaker.Failure(name)
+	}
+	assert.False(t, bot.breaker.Allow(name))
+
+	// the open circuits are kept
+	newCfg := newTestReloadConfig(t)
+	newCfg.Roles["A"].Prompt = "aa"
+	assert.NoError(t, bot.Reload(newCfg))
+	assert.False(t, bot.breaker.Allow(name))
+
+	newCfg = newTestReloadConfig(t)
+	newCfg.CircuitBreakThreshold++
+	assert.NoError(t, bot.Reload(newCfg))
+	assert.True(t, bot.breaker.Allow(name))
+}
+
+// TestBot_Reload_Race is meaningful with -race, the handlers read the config
+// while it is reloaded.
+func TestBot_Reload_Race(t *testing.T) {
+	cfg := newTestReloadConfig(t)
+	cfg.ApiTokens = []string{"secret"}
+	bot, err := NewBot(cfg)
+	assert.NoError(t, err)
+	go bot.DoTasks()
+	defer bot.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			newCfg := newTestReloadConfig(t)
+			newCfg.ApiTokens = []string{"secret"}
+			newCfg.ApiDefaultRole = []string{"A", "B"}[i%2]
+			assert.NoError(t, bot.Reload(newCfg))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		doApiRequest(bot, http.MethodGet, "/v1/models", "secret", "")
+		doApiRequest(bot, http.MethodPost, "/v1/sessions/conv-1/messages", "secret", `{"message":"/summary"}`)
+		bot.limitScopes("/linebot", "U1", "", "A")
+	}
+	<-done
+}
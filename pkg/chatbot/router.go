@@ -0,0 +1,181 @@
+package chatbot
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+)
+
+var (
+	errTaskQueueFull = errors.Error("the task queue is full")
+	errTaskDropped   = errors.Error("the task is dropped by a newer one")
+)
+
+// Dispatch matches the event against the chat commands and pushes the task into
+// the task queue. It returns false if the event is ignored or rejected.
+func (bot *Bot) Dispatch(ev *Event, ch Channel) bool {
+	tasks := bot.route(ev, ch)
+	if len(tasks) == 0 {
+		return false
+	}
+
+	// push outside the lock, the queue is paused by Reload
+	return bot.enqueue(tasks...) == nil
+}
+
+// enqueue pushes the tasks without blocking, so the webhooks return in time.
+// When the queue is full, QueueOverloadPolicy decides. The tasks rejected or
+// dropped are abandoned, which answers the users.
+func (bot *Bot) enqueue(tasks ...Task) error {
+	policy := bot.getConfig().QueueOverloadPolicy
+	for i, task := range tasks {
+		result, dropped := bot.taskQueue.TryPush(bot, task, policy)
+		switch result {
+		case PushCoalesced:
+			log.Infof("the task queue is full, coalesce the task of session %s", task.SessionID())
+		case PushDroppedOldest:
+			log.Warnf("the task queue is full, drop the oldest task of session %s", task.SessionID())
+			bot.abandonTask(dropped, errTaskDropped)
+		case PushFull, PushClosed:
+			err := errBotStopping
+			if result == PushFull {
+				err = errTaskQueueFull
+				log.Warnf("the task queue is full, reject the task of session %s", task.SessionID())
+			}
+			for _, task := range tasks[i:] {
+				bot.abandonTask(task, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (bot *Bot) defaultRole(botPath string) string {
+	cfg := bot.getConfig()
+	if botPath == apiBotPath {
+		return cfg.ApiDefaultRole
+	}
+	if botcfg, ok := cfg.Bots[botPath]; ok {
+		return botcfg.DefaultRole
+	}
+	return ""
+}
+
+// route returns the tasks of the event, nil if the event is ignored.
+func (bot *Bot) route(ev *Event, ch Channel) []Task {
+	cfg := bot.getConfig()
+	bot.mu.RLock()
+	defer bot.mu.RUnlock()
+
+	msg := strings.TrimLeftFunc(ev.Text, unicode.IsSpace)
+	images := make([]*Attachment, 0)
+	var audio *Attachment
+	for _, attachment := range ev.Attachments {
+		switch attachment.Type {
+		case AttachmentImage:
+			images = append(images, attachment)
+		case AttachmentAudio:
+			audio = attachment
+		}
+	}
+	if msg == "" && len(images) == 0 && audio == nil {
+		// ignore events without text, images and audio
+		return nil
+	}
+
+	session := bot.sessMgr.GetSession(ev.SessionID(), bot.defaultRole(ev.BotPath))
+
+	// the limits count the users, or the conversations if the users are unknown
+	userID := ev.UserID
+	if userID == "" {
+		userID = ev.ConversationID
+	}
+	groupID := ""
+	if ev.IsGroup {
+		groupID = ev.ConversationID
+	}
+
+	tasks := make([]Task, 0, 2)
+	if len(images) != 0 {
+		tasks = append(tasks, &AttachImageTask{
+			Session:     session,
+			Attachments: images,
+		})
+		if msg == "" && audio == nil {
+			return tasks
+		}
+	}
+
+	var task Task
+	if audio != nil && msg == "" {
+		task = &ChatTask{
+			BotPath:   ev.BotPath,
+			UserID:    userID,
+			UserName:  ev.UserName,
+			GroupID:   groupID,
+			BotName:   ev.BotName,
+			Session:   session,
+			Audio:     audio,
+			IsGroup:   ev.IsGroup,
+			Mentioned: ev.Mentioned,
+			Channel:   ch,
+		}
+	} else if _, ok := messageMatchCmd(msg, cfg.CmdsClearSession); ok {
+		task = &ClearSessionTask{
+			Session: session,
+			Channel: ch,
+		}
+	} else if role, ok := messageMatchCmd(msg, cfg.CmdsChangeRole); ok {
+		task = &ChangeRoleTask{
+			Session: session,
+			Role:    role,
+			Channel: ch,
+		}
+	} else if _, ok := matchCmdIfAny(msg, cfg.CmdsShowSummary); ok {
+		task = &ShowSummaryTask{
+			Session: session,
+			Channel: ch,
+		}
+	} else if _, ok := matchCmdIfAny(msg, cfg.CmdsShowQuota); ok {
+		task = &ShowQuotaTask{
+			BotPath: ev.BotPath,
+			UserID:  userID,
+			GroupID: groupID,
+			Session: session,
+			Channel: ch,
+		}
+	} else if prompt, ok := matchCmdIfAny(msg, cfg.CmdsDrawImage); ok {
+		task = &DrawImageTask{
+			BotPath: ev.BotPath,
+			UserID:  userID,
+			GroupID: groupID,
+			Session: session,
+			Prompt:  prompt,
+			Channel: ch,
+		}
+	} else {
+		task = &ChatTask{
+			BotPath:   ev.BotPath,
+			UserID:    userID,
+			UserName:  ev.UserName,
+			GroupID:   groupID,
+			BotName:   ev.BotName,
+			Session:   session,
+			Message:   msg,
+			IsGroup:   ev.IsGroup,
+			Mentioned: ev.Mentioned,
+			Channel:   ch,
+		}
+	}
+
+	if chat, ok := task.(*ChatTask); ok && !chat.addressed(bot) {
+		// do not queue the chatter in the groups, it is skipped by ChatTask anyway
+		log.Debugf("skip the message not for AI in session %s", session.ID)
+		return tasks
+	}
+
+	return append(tasks, task)
+}
@@ -1,52 +1,212 @@
 package chatbot
 
 import (
+	"sync"
 	"time"
 
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
 	"github.com/sashabaranov/go-openai"
+	"golang.org/x/exp/slices"
 )
 
 type SessionManager struct {
+	mu       sync.RWMutex
 	Sessions map[string]*Session
+	Store    SessionStore
 }
 
-func NewSessionManager() *SessionManager {
+func NewSessionManager(store SessionStore) *SessionManager {
 	sessMgr := &SessionManager{}
 	sessMgr.Sessions = make(map[string]*Session)
+	sessMgr.Store = store
 	return sessMgr
 }
 
 func (m *SessionManager) GetSession(id string, defaultRole string) *Session {
+	m.mu.RLock()
+	s, ok := m.Sessions[id]
+	m.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if s, ok := m.Sessions[id]; ok {
 		return s
 	}
 
-	s := NewSession(id, defaultRole)
+	s, err := m.Store.Load(id)
+	if err != nil {
+		log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to load session: %s", id)))
+	}
+	if s == nil {
+		s = NewSession(id, defaultRole)
+	}
+
 	m.Sessions[id] = s
 	return s
 }
 
+// FindSession returns the loaded or stored session, or nil if it does not exist.
+func (m *SessionManager) FindSession(id string) *Session {
+	m.mu.RLock()
+	s, ok := m.Sessions[id]
+	m.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	s, err := m.Store.Load(id)
+	if err != nil {
+		log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to load session: %s", id)))
+		return nil
+	}
+	if s == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if loaded, ok := m.Sessions[id]; ok {
+		return loaded
+	}
+	m.Sessions[id] = s
+	return s
+}
+
+// PeekSession returns a snapshot of the session in memory, or the session in
+// the store without keeping it in memory, so listing all the sessions does
+// not load them. It returns nil if the session does not exist.
+func (m *SessionManager) PeekSession(id string) *Session {
+	m.mu.RLock()
+	s, ok := m.Sessions[id]
+	m.mu.RUnlock()
+	if ok {
+		return s.Snapshot()
+	}
+
+	s, err := m.Store.Load(id)
+	if err != nil {
+		log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to load session: %s", id)))
+		return nil
+	}
+	return s
+}
+
+// ListSessionIDs returns the sorted ids of the loaded and stored sessions.
+func (m *SessionManager) ListSessionIDs() ([]string, error) {
+	ids, err := m.Store.List()
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	m.mu.RLock()
+	for id := range m.Sessions {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	m.mu.RUnlock()
+
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// DeleteSession removes the session from the memory and the store.
+func (m *SessionManager) DeleteSession(id string) error {
+	m.mu.Lock()
+	s, ok := m.Sessions[id]
+	delete(m.Sessions, id)
+	m.mu.Unlock()
+
+	// the queued tasks may still hold the session, it must not be saved again
+	if ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.deleted = true
+	}
+
+	err := m.Store.Delete(id)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	return nil
+}
+
+// SaveSession saves the session unless it is deleted.
+func (m *SessionManager) SaveSession(s *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deleted {
+		return
+	}
+
+	err := m.Store.Save(s.snapshot())
+	if err != nil {
+		log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to save session: %s", s.ID)))
+	}
+}
+
 func (m *SessionManager) ClearExpiredSessions(expiryPeriod time.Duration) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	now := time.Now()
 	ids := make([]string, 0)
 	for _, s := range m.Sessions {
-		if len(s.Messages) == 0 {
+		if s.Len() == 0 {
 			continue
 		}
 
-		if now.Sub(s.LastUpdateDate) > expiryPeriod {
+		if now.Sub(s.GetLastUpdateDate()) > expiryPeriod {
 			s.Clear()
+			m.SaveSession(s)
 			ids = append(ids, s.ID)
 		}
 	}
 	return ids
 }
 
+// Flush saves the loaded sessions, e.g. before exit.
+func (m *SessionManager) Flush() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.Sessions {
+		m.SaveSession(s)
+	}
+}
+
+// ResetMissingRoles changes the sessions whose role does not exist to the
+// default role returned by defaultRole, it returns the ids of the changed sessions.
+func (m *SessionManager) ResetMissingRoles(roles cfgs.Roles, defaultRole func(id string) string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]string, 0)
+	for _, s := range m.Sessions {
+		if _, ok := roles[s.GetRole()]; ok {
+			continue
+		}
+		s.ChangeRole(defaultRole(s.ID))
+		m.SaveSession(s)
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
 type Session struct {
+	mu             sync.Mutex
 	ID             string
 	Role           string
 	Messages       []openai.ChatCompletionMessage
 	LastUpdateDate time.Time
+
+	pendingImages []*pendingImage
+	// deleted is set by DeleteSession, SaveSession skips the deleted session
+	deleted bool
 }
 
 func NewSession(id, role string) *Session {
@@ -59,16 +219,75 @@ func NewSession(id, role string) *Session {
 }
 
 func (s *Session) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clear()
+}
+
+func (s *Session) clear() {
 	s.Messages = s.Messages[:0]
 	s.LastUpdateDate = time.Now()
 }
 
 func (s *Session) AddMessage(msg *openai.ChatCompletionMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Messages = append(s.Messages, *msg)
 	s.LastUpdateDate = time.Now()
 }
 
+func (s *Session) SetMessages(msgs []openai.ChatCompletionMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Messages = make([]openai.ChatCompletionMessage, len(msgs))
+	copy(s.Messages, msgs)
+	s.LastUpdateDate = time.Now()
+}
+
 func (s *Session) ChangeRole(role string) {
-	s.Clear()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clear()
 	s.Role = role
 }
+
+func (s *Session) GetRole() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Role
+}
+
+func (s *Session) GetLastUpdateDate() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.LastUpdateDate
+}
+
+func (s *Session) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Messages)
+}
+
+// GetMessages returns a copy of the messages, it is safe to use after the
+// session changed.
+func (s *Session) GetMessages() []openai.ChatCompletionMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := make([]openai.ChatCompletionMessage, len(s.Messages))
+	copy(msgs, s.Messages)
+	return msgs
+}
+
+func (s *Session) Snapshot() *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot()
+}
+
+func (s *Session) snapshot() *Session {
+	snapshot := NewSession(s.ID, s.Role)
+	snapshot.Messages = append(snapshot.Messages, s.Messages...)
+	snapshot.LastUpdateDate = s.LastUpdateDate
+	return snapshot
+}
@@ -0,0 +1,186 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/fsutil"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+)
+
+// SessionStore persists sessions. Load returns nil without error when the
+// session does not exist.
+type SessionStore interface {
+	Load(id string) (*Session, error)
+	Save(s *Session) error
+	Delete(id string) error
+	List() ([]string, error)
+}
+
+const (
+	SessionStoreMemory = cfgs.SessionStoreMemory
+	SessionStoreFile   = cfgs.SessionStoreFile
+)
+
+func NewSessionStore(cfg *cfgs.Config) (SessionStore, error) {
+	switch cfg.SessionStore {
+	case "", SessionStoreMemory:
+		return NewMemorySessionStore(), nil
+	case SessionStoreFile:
+		return NewFileSessionStore(filepath.Join(cfg.LogPath, "sessions")), nil
+	}
+
+	return nil, errors.Errorf("unknown session store: %q", cfg.SessionStore)
+}
+
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	store := &MemorySessionStore{}
+	store.sessions = make(map[string]*Session)
+	return store
+}
+
+func (store *MemorySessionStore) Load(id string) (*Session, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.sessions[id], nil
+}
+
+func (store *MemorySessionStore) Save(s *Session) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.sessions[s.ID] = s
+	return nil
+}
+
+func (store *MemorySessionStore) Delete(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.sessions, id)
+	return nil
+}
+
+func (store *MemorySessionStore) List() ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	ids := make([]string, 0, len(store.sessions))
+	for id := range store.sessions {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// FileSessionStore saves each session as a json file under Dir, named by the
+// escaped session id.
+type FileSessionStore struct {
+	Dir string
+}
+
+func NewFileSessionStore(dir string) *FileSessionStore {
+	return &FileSessionStore{Dir: dir}
+}
+
+func (store *FileSessionStore) sessionPath(id string) string {
+	return filepath.Join(store.Dir, url.PathEscape(id)+".json")
+}
+
+func (store *FileSessionStore) Load(id string) (*Session, error) {
+	data, err := os.ReadFile(store.sessionPath(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.ErrorAt(err)
+	}
+
+	s := &Session{}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, errors.ErrorAtf(err, "unable to decode session: %s", id)
+	}
+
+	return s, nil
+}
+
+// Save writes the session to a temporary file of its own and renames it, so
+// the concurrent saves of a session never mix and a crash keeps the old file.
+func (store *FileSessionStore) Save(s *Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	err = os.MkdirAll(store.Dir, 0755)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	fname := store.sessionPath(s.ID)
+	f, err := os.CreateTemp(store.Dir, filepath.Base(fname)+".*.tmp")
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	tmpName := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fname)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return errors.ErrorAt(err)
+	}
+
+	return nil
+}
+
+func (store *FileSessionStore) Delete(id string) error {
+	err := os.Remove(store.sessionPath(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.ErrorAt(err)
+	}
+	return nil
+}
+
+func (store *FileSessionStore) List() ([]string, error) {
+	ids := make([]string, 0)
+	if !fsutil.ExistsDir(store.Dir) {
+		return ids, nil
+	}
+
+	entries, err := os.ReadDir(store.Dir)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		id, err := url.PathUnescape(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, errors.ErrorAtf(err, "invalid session file: %s", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
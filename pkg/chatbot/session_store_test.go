@@ -0,0 +1,85 @@
+package chatbot
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	store := NewFileSessionStore(t.TempDir())
+
+	s, err := store.Load("/linebot/U1234")
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+
+	s = NewSession("/linebot/U1234", "聊天機器人")
+	s.AddMessage(&openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "hello"})
+	assert.NoError(t, store.Save(s))
+
+	ids, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/linebot/U1234"}, ids)
+
+	sessMgr := NewSessionManager(store)
+	loaded := sessMgr.GetSession("/linebot/U1234", "無")
+	assert.Equal(t, "聊天機器人", loaded.Role)
+	assert.Equal(t, s.Messages, loaded.Messages)
+	assert.True(t, s.LastUpdateDate.Equal(loaded.LastUpdateDate))
+
+	assert.NoError(t, store.Delete("/linebot/U1234"))
+	ids, err = store.List()
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestFileSessionStore_concurrentSave(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileSessionStore(dir)
+	s := NewSession("/linebot/U1234", "聊天機器人")
+	s.AddMessage(&openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "hello"})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, store.Save(s.Snapshot()))
+		}()
+	}
+	wg.Wait()
+
+	loaded, err := store.Load("/linebot/U1234")
+	assert.NoError(t, err)
+	assert.Equal(t, s.Messages, loaded.Messages)
+
+	// no temporary file is left
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestSessionManager_DeleteSession(t *testing.T) {
+	store := NewFileSessionStore(t.TempDir())
+	sessMgr := NewSessionManager(store)
+	s := sessMgr.GetSession("/linebot/U1234", "聊天機器人")
+	s.AddMessage(&openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "hello"})
+	sessMgr.SaveSession(s)
+
+	assert.NoError(t, sessMgr.DeleteSession("/linebot/U1234"))
+	// a queued task still holds the deleted session
+	s.AddMessage(&openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "again"})
+	sessMgr.SaveSession(s)
+	assert.Nil(t, sessMgr.FindSession("/linebot/U1234"))
+
+	// the new session of the same id is saved
+	s = sessMgr.GetSession("/linebot/U1234", "聊天機器人")
+	s.AddMessage(&openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "hi"})
+	sessMgr.SaveSession(s)
+	loaded, err := store.Load("/linebot/U1234")
+	assert.NoError(t, err)
+	assert.Equal(t, s.Messages, loaded.Messages)
+}
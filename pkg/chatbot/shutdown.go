@@ -0,0 +1,122 @@
+package chatbot
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+)
+
+// shutdownGrace is the time for the requests to finish after the tasks are
+// drained.
+const shutdownGrace = 5 * time.Second
+
+var errBotStopping = errors.Error("the bot is stopping")
+
+// shutdown stops accepting the requests, and waits for the requests in flight
+// until the tasks are drained, since some of them wait for their tasks.
+func (bot *Bot) shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), bot.getConfig().ShutdownTimeout+shutdownGrace)
+	defer cancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- server.Shutdown(ctx)
+	}()
+
+	<-bot.drained
+	err := <-shutdownErr
+	if err != nil {
+		log.Warnf("close the connections in flight: %v", err)
+		server.Close()
+	}
+}
+
+// drainTasks lets the workers finish the waiting tasks until ShutdownTimeout,
+// the tasks left are abandoned with a reply, then the sessions are saved.
+func (bot *Bot) drainTasks(workers *sync.WaitGroup) {
+	timeout := bot.getConfig().ShutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	bot.taskQueue.Drain()
+	log.Infof("drain the task queue, %d tasks are waiting", bot.taskQueue.Len())
+
+	idle := make(chan struct{})
+	go func() {
+		// returns when the queue is idle or closed
+		bot.taskQueue.WaitIdle()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		log.Warnf("the tasks are not done in %v", timeout)
+	}
+
+	tasks := bot.taskQueue.Close()
+	if len(tasks) != 0 {
+		log.Warnf("abandon %d waiting tasks", len(tasks))
+	}
+	for _, task := range tasks {
+		bot.abandonTask(task, errBotStopping)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("abandon the running tasks")
+	}
+
+	bot.sessMgr.Flush()
+	log.Info("the task queue is drained")
+}
+
+// abandoner is the task which tells the user why it is not done, err is
+// errBotStopping, errTaskQueueFull or errTaskDropped.
+type abandoner interface {
+	abandon(bot *Bot, err error)
+}
+
+func (bot *Bot) abandonTask(task Task, err error) {
+	if task, ok := task.(abandoner); ok {
+		task.abandon(bot, err)
+	}
+}
+
+func (task *ChatTask) abandon(bot *Bot, err error) {
+	if !task.addressed(bot) {
+		return
+	}
+
+	var text string
+	switch {
+	case errors.Is(err, errBotStopping):
+		text = "小愛正在重新啟動，請稍後再說一次"
+	case errors.Is(err, errTaskQueueFull):
+		text = "小愛現在太忙了，請稍後再說一次"
+	default:
+		// a newer message of the session is answered instead
+		log.Infof("session(%s) abandon the message: %v", task.Session.ID, err)
+		return
+	}
+
+	err = task.reply(&Reply{Text: text})
+	if err != nil {
+		log.ErrorAt(err)
+	}
+}
+
+func (task *waitTask) abandon(bot *Bot, err error) {
+	bot.abandonTask(task.Task, err)
+	task.err = err
+	close(task.done)
+}
@@ -0,0 +1,72 @@
+package chatbot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type blockingTask struct {
+	id      string
+	release chan struct{}
+}
+
+func (task *blockingTask) Do(bot *Bot) error {
+	<-task.release
+	return nil
+}
+
+func (task *blockingTask) SessionID() string { return task.id }
+
+type doneTask struct {
+	id   string
+	done bool
+}
+
+func (task *doneTask) Do(bot *Bot) error {
+	task.done = true
+	return nil
+}
+
+func (task *doneTask) SessionID() string { return task.id }
+
+func TestBot_drainTasks(t *testing.T) {
+	cfg := newTestReloadConfig(t)
+	cfg.TaskWorkerCount = 2
+	cfg.ShutdownTimeout = 100 * time.Millisecond
+	bot, err := NewBot(cfg)
+	assert.NoError(t, err)
+
+	replies := make([]string, 0)
+	ch := &funcChannel{reply: func(reply *Reply) error {
+		replies = append(replies, reply.Text)
+		return nil
+	}}
+
+	release := make(chan struct{})
+	defer close(release)
+	pushTask(bot.taskQueue, &blockingTask{id: "/a", release: release})
+	// waits behind the blocking task until the timeout
+	pushTask(bot.taskQueue, &ChatTask{Session: bot.sessMgr.GetSession("/a", "A"), Channel: ch})
+	// the chatter in the group is not told that the bot is restarting
+	pushTask(bot.taskQueue, &ChatTask{Session: bot.sessMgr.GetSession("/a", "A"), Message: "hello", IsGroup: true, Channel: ch})
+	done := &doneTask{id: "/b"}
+	pushTask(bot.taskQueue, done)
+
+	go bot.DoTasks()
+	bot.Stop()
+	bot.Stop()
+	select {
+	case <-bot.drained:
+	case <-time.After(time.Second):
+		t.Fatal("the task queue is not drained")
+	}
+
+	assert.True(t, done.done)
+	assert.Equal(t, []string{"小愛正在重新啟動，請稍後再說一次"}, replies)
+
+	// the events after the stop are answered too
+	assert.False(t, bot.Dispatch(&Event{BotPath: "/linebot", ConversationID: "U1", Text: "hi"}, ch))
+	assert.Len(t, replies, 2)
+}
@@ -0,0 +1,132 @@
+package chatbot
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+)
+
+// maxSpeechInput is the max length of the input of the speech endpoint.
+const maxSpeechInput = 4096
+
+// synthesizeSpeech speaks the text through the OpenAI-compatible speech
+// endpoint and saves the audio in the media store.
+func (bot *Bot) synthesizeSpeech(role *cfgs.Role, text string) (*ReplyAudio, error) {
+	cfg := bot.getConfig()
+	if runes := []rune(text); len(runes) > maxSpeechInput {
+		text = string(runes[:maxSpeechInput])
+	}
+
+	voice := cfg.TtsVoice
+	if role.TtsVoice != "" {
+		voice = role.TtsVoice
+	}
+
+	log.Debugf("synthesize speech with voice %s ...", voice)
+	resp, err := bot.ttsClient.CreateSpeech(context.Background(), openai.CreateSpeechRequest{
+		Model:          openai.SpeechModel(cfg.TtsModel),
+		Input:          text,
+		Voice:          openai.SpeechVoice(voice),
+		ResponseFormat: openai.SpeechResponseFormatMp3,
+	})
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	defer resp.Close()
+
+	data, err := io.ReadAll(resp)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	name, err := bot.media.Save(data, "mp3")
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	url, err := bot.mediaUrl(name)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	return &ReplyAudio{Url: url, Duration: mp3Duration(data)}, nil
+}
+
+// speak returns the voice of the reply if the role speaks, nil if it does not
+// or the speech fails, so the text reply still goes out.
+func (task *ChatTask) speak(bot *Bot, role *cfgs.Role, content string) *ReplyAudio {
+	if !role.TextToSpeech {
+		return nil
+	}
+
+	text, _ := getImageUrlsFromReply(content)
+	audio, err := bot.synthesizeSpeech(role, text)
+	if err != nil {
+		log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to synthesize speech for session %s", task.Session.ID)))
+		return nil
+	}
+	return audio
+}
+
+var (
+	mp3Bitrates = [2][16]int{
+		// MPEG-1 Layer III
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		// MPEG-2/2.5 Layer III
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	}
+	mp3SampleRates = map[byte][3]int{
+		3: {44100, 48000, 32000}, // MPEG-1
+		2: {22050, 24000, 16000}, // MPEG-2
+		0: {11025, 12000, 8000},  // MPEG-2.5
+	}
+)
+
+// mp3Duration sums the durations of the Layer III frames in the data.
+func mp3Duration(data []byte) time.Duration {
+	i := 0
+	// skip the ID3v2 tag
+	if len(data) >= 10 && string(data[:3]) == "ID3" {
+		i = 10 + (int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9]))
+	}
+
+	var duration time.Duration
+	for i+4 <= len(data) {
+		if data[i] != 0xFF || data[i+1]&0xE0 != 0xE0 {
+			i++
+			continue
+		}
+
+		version := (data[i+1] >> 3) & 0x03
+		layer := (data[i+1] >> 1) & 0x03
+		bitrateIdx := data[i+2] >> 4
+		sampleRateIdx := (data[i+2] >> 2) & 0x03
+		padding := int((data[i+2] >> 1) & 0x01)
+		sampleRates, ok := mp3SampleRates[version]
+		if !ok || layer != 1 || sampleRateIdx == 3 {
+			i++
+			continue
+		}
+
+		table, samples, coef := 0, 1152, 144
+		if version != 3 {
+			table, samples, coef = 1, 576, 72
+		}
+		bitrate := mp3Bitrates[table][bitrateIdx] * 1000
+		sampleRate := sampleRates[sampleRateIdx]
+		if bitrate == 0 {
+			i++
+			continue
+		}
+
+		duration += time.Duration(samples) * time.Second / time.Duration(sampleRate)
+		i += coef*bitrate/sampleRate + padding
+	}
+
+	return duration
+}
@@ -0,0 +1,70 @@
+package chatbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestMp3 returns MPEG-1 Layer III frames of 128kbps 44.1kHz.
+func newTestMp3(frames int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x64})
+	return bytes.Repeat(frame, frames)
+}
+
+func Test_mp3Duration(t *testing.T) {
+	assert.Equal(t, 2612, int(mp3Duration(newTestMp3(100)).Milliseconds()))
+
+	id3 := append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, 5, 0xFF, 0xFB, 0x90, 0x64, 0}, newTestMp3(10)...)
+	assert.Equal(t, 261, int(mp3Duration(id3).Milliseconds()))
+
+	assert.Zero(t, mp3Duration([]byte("not mp3")))
+}
+
+func TestChatTask_speak(t *testing.T) {
+	mp3 := newTestMp3(100)
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/audio/speech", r.URL.Path)
+		req := map[string]any{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "Hello", req["input"])
+		assert.Equal(t, "nova", req["voice"])
+		assert.Equal(t, "tts-1", req["model"])
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write(mp3)
+	})
+	bot.ttsClient = bot.gptClient
+	bot.media = NewMediaStore(t.TempDir())
+	bot.cfg.Store(&cfgs.Config{
+		TtsModel:  "tts-1",
+		TtsVoice:  "alloy",
+		PublicUrl: "https://example.com/",
+	})
+
+	task := &ChatTask{Session: NewSession("test", "test")}
+	assert.Nil(t, task.speak(bot, &cfgs.Role{}, "Hello"))
+
+	audio := task.speak(bot, &cfgs.Role{TextToSpeech: true, TtsVoice: "nova"}, "Hello")
+	if assert.NotNil(t, audio) {
+		assert.Regexp(t, `^https://example.com/media/[0-9a-f]{32}\.mp3$`, audio.Url)
+		assert.Equal(t, mp3Duration(mp3), audio.Duration)
+	}
+
+	engine := gin.New()
+	engine.GET("/media/:name", bot.mediaHandler)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, audio.Url[len("https://example.com"):], nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, mp3, w.Body.Bytes())
+
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/media/..%2Fsecret.mp3", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,153 @@
+package chatbot
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+)
+
+// streamChatCompletion receives the answer token by token. When the role enables
+// StreamPushParagraph, finished paragraphs are delivered as soon as they arrive and
+// delivered is true. If the endpoint does not support streaming, it falls back to
+// the blocking request.
+func (task *ChatTask) streamChatCompletion(bot *Bot, role *cfgs.Role, req openai.ChatCompletionRequest) (content string, delivered bool, err error) {
+	if task.Channel != nil {
+		err := task.Channel.ShowLoading()
+		if err != nil {
+			log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to show loading indicator: %s", task.Session.ID)))
+		}
+	}
+
+	cfg := bot.getConfig()
+	ctx := context.Background()
+	var stream ChatCompletionStream
+	cancelStream := context.CancelFunc(func() {})
+	err = task.callWithFallback(ctx, bot, req, func(completer ChatCompleter, req openai.ChatCompletionRequest) error {
+		// each attempt has the timeout of its own, which also bounds reading
+		// the stream of the successful one
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if cfg.RequestTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, cfg.RequestTimeout)
+		}
+
+		var err error
+		stream, err = completer.CreateChatCompletionStream(attemptCtx, req)
+		if err != nil {
+			cancel()
+			return err
+		}
+		cancelStream = cancel
+		return nil
+	})
+	defer cancelStream()
+	if err != nil {
+		if !isStreamUnsupported(err) {
+			return "", false, errors.ErrorAt(err)
+		}
+		log.Warnf("streaming is not supported, fallback to blocking request: %v", err)
+		content, err := task.createChatCompletion(bot, req)
+		return content, false, err
+	}
+	defer stream.Close()
+
+	pushParagraph := role.StreamPushParagraph && task.Channel != nil
+	sb := &strings.Builder{}
+	sent := 0
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if sb.Len() == 0 {
+				log.Warnf("streaming failed before any content, fallback to blocking request: %v", err)
+				content, err := task.createChatCompletion(bot, req)
+				return content, false, err
+			}
+			return sb.String(), task.replied, errors.ErrorAt(err)
+		}
+
+		if len(resp.Choices) == 0 {
+			continue
+		}
+		sb.WriteString(resp.Choices[0].Delta.Content)
+
+		if pushParagraph {
+			paragraphs, rest := splitParagraphs(sb.String()[sent:])
+			if len(paragraphs) != 0 {
+				err = task.replyContent(strings.Join(paragraphs, "\n\n"), nil)
+				if err != nil {
+					return sb.String(), task.replied, errors.ErrorAt(err)
+				}
+				sent = sb.Len() - len(rest)
+			}
+		}
+	}
+
+	if sb.Len() == 0 {
+		log.Warn("streaming returns no content, fallback to blocking request")
+		content, err := task.createChatCompletion(bot, req)
+		return content, false, err
+	}
+
+	if !pushParagraph {
+		return sb.String(), false, nil
+	}
+
+	err = task.replyContent(sb.String()[sent:], nil)
+	if err != nil {
+		return sb.String(), true, errors.ErrorAt(err)
+	}
+
+	return sb.String(), true, nil
+}
+
+// splitParagraphs returns the complete paragraphs of text and the unfinished
+// tail. The blank lines inside the ``` code blocks do not split, so a code
+// block is sent in one piece.
+func splitParagraphs(text string) ([]string, string) {
+	paragraphs := make([]string, 0)
+	inFence := false
+	start := 0
+	for i := 0; ; {
+		n := strings.IndexByte(text[i:], '\n')
+		if n < 0 {
+			break
+		}
+		line := text[i : i+n]
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+		}
+		if line == "" && !inFence {
+			if p := text[start:max(start, i-1)]; strings.TrimSpace(p) != "" {
+				paragraphs = append(paragraphs, p)
+			}
+			start = i + 1
+		}
+		i += n + 1
+	}
+
+	if len(paragraphs) == 0 {
+		return nil, text
+	}
+	return paragraphs, text[start:]
+}
+
+func isStreamUnsupported(err error) bool {
+	if errors.Is(err, openai.ErrChatCompletionStreamNotSupported) {
+		return true
+	}
+
+	switch GetOpenAIErrCode(err) {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType, http.StatusNotImplemented:
+		return true
+	}
+
+	return false
+}
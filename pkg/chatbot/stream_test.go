@@ -0,0 +1,113 @@
+package chatbot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_splitParagraphs(t *testing.T) {
+	paragraphs, rest := splitParagraphs("第一段\n\n第二段\n\n\n\n第三")
+	assert.Equal(t, []string{"第一段", "第二段"}, paragraphs)
+	assert.Equal(t, "第三", rest)
+
+	paragraphs, rest = splitParagraphs("還沒結束")
+	assert.Empty(t, paragraphs)
+	assert.Equal(t, "還沒結束", rest)
+
+	// the code blocks are not split
+	paragraphs, rest = splitParagraphs("程式：\n\n```go\na := 1\n\nb := 2\n```\n\n```\n\n")
+	assert.Equal(t, []string{"程式：", "```go\na := 1\n\nb := 2\n```"}, paragraphs)
+	assert.Equal(t, "```\n\n", rest)
+}
+
+type fakeChannel struct {
+	replies  []*Reply
+	pushes   []*Reply
+	loadings int
+}
+
+func (ch *fakeChannel) Reply(reply *Reply) error {
+	ch.replies = append(ch.replies, reply)
+	return nil
+}
+
+func (ch *fakeChannel) Push(reply *Reply) error {
+	ch.pushes = append(ch.pushes, reply)
+	return nil
+}
+
+func (ch *fakeChannel) ShowLoading() error {
+	ch.loadings++
+	return nil
+}
+
+func newTestGptBot(t *testing.T, handler http.HandlerFunc) *Bot {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	gptCfg := openai.DefaultConfig("test")
+	gptCfg.BaseURL = server.URL
+	bot := &Bot{gptClient: openai.NewClientWithConfig(gptCfg), limiter: NewRateLimiter()}
+	bot.cfg.Store(&cfgs.Config{})
+	bot.providers = map[string]ChatCompleter{cfgs.DefaultProvider: newOpenAIChatCompleter(bot.gptClient)}
+	return bot
+}
+
+func TestChatTask_streamChatCompletion(t *testing.T) {
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, token := range []string{"第一", "段\\n\\n", "第二段"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"%s\"}}]}\n\n", token)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	ch := &fakeChannel{}
+	task := &ChatTask{
+		Session: NewSession("test", "test"),
+		Channel: ch,
+	}
+
+	content, delivered, err := task.streamChatCompletion(bot, &cfgs.Role{Stream: true, StreamPushParagraph: true}, openai.ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.True(t, delivered)
+	assert.Equal(t, "第一段\n\n第二段", content)
+	assert.Equal(t, []*Reply{{Text: "第一段", ImageUrls: []string{}}}, ch.replies)
+	assert.Equal(t, []*Reply{{Text: "第二段", ImageUrls: []string{}}}, ch.pushes)
+	assert.Equal(t, 1, ch.loadings)
+}
+
+func TestChatTask_streamChatCompletion_Fallback(t *testing.T) {
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"blocking"}}]}`)
+	})
+
+	task := &ChatTask{Session: NewSession("test", "test")}
+	content, delivered, err := task.streamChatCompletion(bot, &cfgs.Role{Stream: true}, openai.ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.False(t, delivered)
+	assert.Equal(t, "blocking", content)
+}
+
+func TestChatTask_streamChatCompletion_Timeout(t *testing.T) {
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"第一段\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	bot.getConfig().RequestTimeout = 100 * time.Millisecond
+
+	task := &ChatTask{Session: NewSession("test", "test")}
+	content, _, err := task.streamChatCompletion(bot, &cfgs.Role{Stream: true}, openai.ChatCompletionRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, "第一段", content)
+}
@@ -0,0 +1,125 @@
+package chatbot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	summaryPrefix = "先前對話的摘要:\n"
+	summaryPrompt = "請將以下對話整理成一段簡潔的摘要，保留人物、重要的事實、決定與尚未解決的問題，摘要會取代原本的對話讓你記得之前聊過什麼。如果有先前的摘要，請一併整合。只回覆摘要內容，用繁體中文。"
+)
+
+func isSummaryMessage(msg *openai.ChatCompletionMessage) bool {
+	return msg.Role == openai.ChatMessageRoleSystem && strings.HasPrefix(msg.Content, summaryPrefix)
+}
+
+// getSummary returns the running summary of the messages, empty if there is none.
+func getSummary(msgs []openai.ChatCompletionMessage) string {
+	pinned, _ := splitTurns(msgs)
+	for i := range msgs[:pinned] {
+		if isSummaryMessage(&msgs[i]) {
+			return strings.TrimPrefix(msgs[i].Content, summaryPrefix)
+		}
+	}
+	return ""
+}
+
+// summarizeMessages compresses the oldest turns into the running summary when
+// the turns grow past the threshold of the role or the oldest turns would be
+// trimmed. It returns the messages unchanged if there is nothing to compress.
+func (task *ChatTask) summarizeMessages(bot *Bot, role *cfgs.Role, model string, msgs []openai.ChatCompletionMessage) ([]openai.ChatCompletionMessage, error) {
+	pinned, turnStarts := splitTurns(msgs)
+
+	compress := 0
+	if len(turnStarts) > role.SummarizeThreshold {
+		compress = len(turnStarts) - role.SummarizeThreshold/2
+	}
+	_, dropped := trimTurns(msgs, role.MaxConversationCount, contextTokenBudget(role, model), NewTokenCounter(model))
+	compress = min(max(compress, dropped), len(turnStarts)-1)
+	if compress <= 0 {
+		return msgs, nil
+	}
+
+	sb := &strings.Builder{}
+	prompts := make([]openai.ChatCompletionMessage, 0, pinned)
+	for i := range msgs[:pinned] {
+		if isSummaryMessage(&msgs[i]) {
+			fmt.Fprintf(sb, "先前的摘要: %s\n", strings.TrimPrefix(msgs[i].Content, summaryPrefix))
+			continue
+		}
+		prompts = append(prompts, msgs[i])
+	}
+	for _, msg := range msgs[turnStarts[0]:turnStarts[compress]] {
+		text := messageText(&msg)
+		if text == "" {
+			continue
+		}
+		fmt.Fprintf(sb, "%s: %s\n", msg.Role, text)
+	}
+
+	// the summary is a request of its own, the old turns are trimmed instead if
+	// the quotas are used up
+	err := bot.limiter.AllowQuota(task.scopes)
+	if err != nil {
+		return msgs, errors.ErrorAt(err)
+	}
+
+	log.Debugf("summarize %d turns of session %s ...", compress, task.Session.ID)
+	req := openai.ChatCompletionRequest{
+		Model: model,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: summaryPrompt},
+			{Role: openai.ChatMessageRoleUser, Content: sb.String()},
+		},
+	}
+	summary, err := task.createChatCompletion(bot, req)
+	if err != nil {
+		return msgs, errors.ErrorAt(err)
+	}
+	bot.limiter.AddTokens(task.scopes, NewTokenCounter(model).CountTokens(append(req.Messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: summary,
+	})))
+
+	summarized := make([]openai.ChatCompletionMessage, 0, len(prompts)+1+len(msgs)-turnStarts[compress])
+	summarized = append(summarized, prompts...)
+	summarized = append(summarized, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: summaryPrefix + strings.TrimSpace(summary),
+	})
+	summarized = append(summarized, msgs[turnStarts[compress]:]...)
+
+	return summarized, nil
+}
+
+type ShowSummaryTask struct {
+	Session *Session
+	Channel Channel
+}
+
+func (task *ShowSummaryTask) SessionID() string {
+	return task.Session.ID
+}
+
+func (task *ShowSummaryTask) Do(bot *Bot) error {
+	summary := getSummary(task.Session.GetMessages())
+	msg := "目前沒有對話摘要"
+	if summary != "" {
+		msg = "對話摘要:\n" + summary
+	}
+
+	if task.Channel != nil {
+		log.Debug("reply message ...")
+		err := task.Channel.Reply(&Reply{Text: msg})
+		if err != nil {
+			return errors.ErrorAt(err)
+		}
+	}
+	return nil
+}
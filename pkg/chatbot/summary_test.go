@@ -0,0 +1,39 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatTask_summarizeMessages(t *testing.T) {
+	var summarized string
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		req := openai.ChatCompletionRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		summarized = req.Messages[1].Content
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"q1 q2 的摘要"}}]}`)
+	})
+
+	task := &ChatTask{Session: NewSession("test", "test")}
+	role := &cfgs.Role{SummarizeThreshold: 2}
+	msgs := newTestMessages("q1", "a1", "q2", "a2", "q3")
+
+	msgs, err := task.summarizeMessages(bot, role, "gpt-3.5-turbo", msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, "user: q1\nassistant: a1\nuser: q2\nassistant: a2\n", summarized)
+	assert.Equal(t, "q1 q2 的摘要", getSummary(msgs))
+
+	expected := newTestMessages("q3")
+	expected = append(expected[:1], openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: summaryPrefix + "q1 q2 的摘要"}, expected[1])
+	assert.Equal(t, expected, msgs)
+
+	msgs, err = task.summarizeMessages(bot, role, "gpt-3.5-turbo", msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, msgs)
+}
@@ -3,6 +3,7 @@ package chatbot
 import (
 	"context"
 	"fmt"
+	"math"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"github.com/jopbrown/gobase/errors"
 	"github.com/jopbrown/gobase/log"
 	"github.com/jopbrown/gobase/log/rotate"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
 	"github.com/sashabaranov/go-openai"
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
@@ -18,46 +20,81 @@ import (
 
 type Task interface {
 	Do(bot *Bot) error
+	SessionID() string
 }
 
 type ChatTask struct {
+	BotPath  string
+	UserID   string
 	UserName string
-	BotName  string
-	Session  *Session
-	Message  string
-	IsGroup  bool
-	ReplyFn  func(reply string, imgUrls ...string) error
+	// GroupID is the conversation of the group, it is empty in the private chats.
+	GroupID   string
+	BotName   string
+	Session   *Session
+	Message   string
+	IsGroup   bool
+	Mentioned bool
+	Channel   Channel
+	// Audio is the voice message, its transcript is used as the message.
+	Audio *Attachment
+
+	replied    bool
+	transcript string
+	routes     []*chatRoute
+	usedModel  string
+	// scopes are the limits of the message, the extra requests count in them
+	scopes []*limitScope
+	// images are drawn by the tools, they are sent with the answer
+	images []string
 }
 
 func (task *ChatTask) Do(bot *Bot) error {
+	cfg := bot.getConfig()
 	log.Debugf("do chat task...\n %+v", task)
 
-	recorder, err := rotate.OpenFile(filepath.Join(bot.cfg.LogPath, "chats", fmt.Sprintf("%s.txt", task.Session.ID)), 24*time.Hour, 0)
+	recorder, err := rotate.OpenFile(filepath.Join(cfg.LogPath, "chats", fmt.Sprintf("%s.txt", task.Session.ID)), 24*time.Hour, 0)
 	if err != nil {
 		return errors.ErrorAt(err)
 	}
 	defer recorder.Close()
 
-	role := bot.cfg.Roles[task.Session.Role]
-	if role.MaxConversationCount > 0 && len(task.Session.Messages) >= role.MaxConversationCount*2+1 {
-		task.Session.Clear()
+	role, ok := cfg.Roles[task.Session.GetRole()]
+	if !ok {
+		// the role is removed from the config since the session was saved
+		defaultRole := bot.defaultRole(task.BotPath)
+		role, ok = cfg.Roles[defaultRole]
+		if !ok {
+			return errors.Errorf("unknown role of session %s: %s", task.Session.ID, task.Session.GetRole())
+		}
+		log.Infof("session(%s) 角色<%s>不存在，變更為<%s>", task.Session.ID, task.Session.GetRole(), defaultRole)
+		task.Session.ChangeRole(defaultRole)
 	}
 
-	cmds := bot.cfg.CmdsTalkToAI
-	if len(role.CmdsTalkToAI) > 0 {
-		cmds = role.CmdsTalkToAI
-	}
-	if task.BotName != "" {
-		cmds = append(cmds, "@"+task.BotName)
-	}
-	msg := task.Message
-	msg, isTalkToAI := messageMatchCmd(msg, cmds)
-	if task.IsGroup && !isTalkToAI && !role.NotNeedSlashCmd {
+	msg, isTalkToAI := bot.talkToAI(task, role)
+	if !isTalkToAI {
 		log.Debug("skip talk to AI")
 		return nil
 	}
 
-	if len(task.Session.Messages) == 0 && len(role.Prompt) != 0 {
+	task.scopes = bot.limitScopes(task.BotPath, task.UserID, task.GroupID, task.Session.GetRole())
+	err = bot.limiter.Allow(task.scopes)
+	if err != nil {
+		return task.replyLimited(bot, err)
+	}
+
+	if task.Audio != nil {
+		task.transcript, err = bot.transcribeAudio(task.Audio)
+		if err != nil {
+			return task.replyError(err)
+		}
+		if task.transcript == "" {
+			log.Debug("skip empty transcript")
+			return nil
+		}
+		msg = task.transcript
+	}
+
+	if task.Session.Len() == 0 && len(role.Prompt) != 0 {
 		log.Debug("append system message ...")
 		task.Session.AddMessage(&openai.ChatCompletionMessage{
 			Role:    openai.ChatMessageRoleSystem,
@@ -77,57 +114,237 @@ func (task *ChatTask) Do(bot *Bot) error {
 	chatMsg := &openai.ChatCompletionMessage{}
 	chatMsg.Content = msg
 	chatMsg.Role = openai.ChatMessageRoleUser
+	imgUrls := task.Session.TakePendingImages(cfg.ImageHoldPeriod)
+	if len(imgUrls) != 0 && role.VisionModel == "" {
+		log.Infof("drop %d images, role<%s> has no vision model", len(imgUrls), task.Session.GetRole())
+	} else if len(imgUrls) != 0 {
+		log.Infof("attach %d images", len(imgUrls))
+		fmt.Fprintf(recorder, "(%d images)\n", len(imgUrls))
+		chatMsg = newImageMessage(openai.ChatMessageRoleUser, msg, imgUrls)
+	}
 	task.Session.AddMessage(chatMsg)
 
+	task.routes, err = bot.chatRoutes(task.BotPath, role)
+	if err != nil {
+		return task.replyError(err)
+	}
+	model := task.routes[0].model
+	msgs := task.Session.GetMessages()
+	if role.VisionModel != "" && hasImage(msgs) {
+		model = role.VisionModel
+	}
+	if role.SummarizeThreshold > 0 {
+		summarized, err := task.summarizeMessages(bot, role, model, msgs)
+		if err != nil {
+			log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to summarize session: %s", task.Session.ID)))
+		} else if len(summarized) != len(msgs) {
+			summary := getSummary(summarized)
+			log.Info("summary:", summary)
+			fmt.Fprintln(recorder, "summary:", summary)
+			task.Session.SetMessages(summarized)
+			msgs = summarized
+		}
+	}
+
+	trimmed := trimMessages(msgs, role.MaxConversationCount, contextTokenBudget(role, model), NewTokenCounter(model))
+	if len(trimmed) != len(msgs) {
+		log.Debugf("trim %d old messages of session %s", len(msgs)-len(trimmed), task.Session.ID)
+		task.Session.SetMessages(trimmed)
+	}
+
 	log.Debug("send message to chatgpt ...")
-	resp, err := bot.gptClient.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model:    bot.cfg.ChatGptModel,
-			Messages: task.Session.Messages,
-		},
-	)
+	req := openai.ChatCompletionRequest{
+		Model:    model,
+		Messages: trimmed,
+	}
+	applyRoleParams(&req, role)
 
+	var content string
+	var delivered bool
+	if len(role.Tools) != 0 {
+		content, err = task.createChatCompletionWithTools(bot, req, bot.tools.Definitions(role.Tools))
+	} else if role.Stream {
+		content, delivered, err = task.streamChatCompletion(bot, role, req)
+	} else {
+		content, err = task.createChatCompletion(bot, req)
+	}
+	// the images are sent once, the history keeps their placeholders
+	if hasImage(trimmed) {
+		task.Session.SetMessages(stripImages(task.Session.GetMessages()))
+	}
 	if err != nil {
-		if task.ReplyFn != nil {
-			var err1 error
-			switch GetOpenAIErrCode(err) {
-			case 401:
-				err1 = task.ReplyFn(fmt.Sprintf("AI的token過期了，請聯繫管理員更新:\n%s", errors.GetErrorDetails(err)))
-			case 500:
-				err1 = task.ReplyFn(fmt.Sprintf("Server掛掉了，請聯繫管理員:\n%s", errors.GetErrorDetails(err)))
-			default:
-				err1 = task.ReplyFn(fmt.Sprintf("小愛壞掉了，可以嘗試輸入清空指令修復:\n%s", errors.GetErrorDetails(err)))
-			}
-
-			if err1 != nil {
-				return errors.ErrorAt(errors.Join(err, err1))
-			}
-		}
-		return errors.ErrorAt(err)
+		return task.replyError(err)
 	}
 
 	respMsg := &openai.ChatCompletionMessage{}
 	respMsg.Role = openai.ChatMessageRoleAssistant
-	respMsg.Content = resp.Choices[0].Message.Content
+	respMsg.Content = content
 
 	task.Session.AddMessage(respMsg)
-	log.Info("AI:", respMsg.Content)
-	fmt.Fprintln(recorder, "AI:", respMsg.Content)
-
-	if task.ReplyFn != nil {
-		log.Debug("replay message to line ...")
-		reply, urls := getImageUrlsFromReply(respMsg.Content)
-		reply = strings.TrimSpace(reply)
-		err = task.ReplyFn(reply, urls...)
-		if err != nil {
-			return errors.ErrorAt(err)
+	bot.sessMgr.SaveSession(task.Session)
+	// estimated like the context, since the streams do not report the usage
+	bot.limiter.AddTokens(task.scopes, NewTokenCounter(model).CountTokens(append(trimmed, *respMsg)))
+	log.Infof("AI(%s): %s", task.usedModel, respMsg.Content)
+	fmt.Fprintf(recorder, "AI(%s): %s\n", task.usedModel, respMsg.Content)
+
+	audio := task.speak(bot, role, respMsg.Content)
+	if !delivered {
+		err = task.replyContent(respMsg.Content, audio)
+	} else if audio != nil {
+		err = task.reply(&Reply{Audio: audio})
+	}
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	return nil
+}
+
+// talkToAI trims the command talking to AI from the message, and reports
+// whether the message is for AI. The messages in the private chats always are.
+func (bot *Bot) talkToAI(task *ChatTask, role *cfgs.Role) (string, bool) {
+	cfg := bot.getConfig()
+	cmds := make([]string, 0, len(cfg.CmdsTalkToAI)+1)
+	if len(role.CmdsTalkToAI) > 0 {
+		cmds = append(cmds, role.CmdsTalkToAI...)
+	} else {
+		cmds = append(cmds, cfg.CmdsTalkToAI...)
+	}
+	if task.BotName != "" {
+		cmds = append(cmds, "@"+task.BotName)
+	}
+
+	msg, ok := messageMatchCmd(task.Message, cmds)
+	return msg, ok || task.Mentioned || !task.IsGroup || role.NotNeedSlashCmd
+}
+
+// addressed reports whether the task talks to AI, the others are the chatter
+// in the groups, which is neither answered nor told that the bot is busy.
+func (task *ChatTask) addressed(bot *Bot) bool {
+	cfg := bot.getConfig()
+	role, ok := cfg.Roles[task.Session.GetRole()]
+	if !ok {
+		role, ok = cfg.Roles[bot.defaultRole(task.BotPath)]
+	}
+	if !ok {
+		role = &cfgs.Role{}
+	}
+	_, ok = bot.talkToAI(task, role)
+	return ok
+}
+
+// coalesce appends the message of the next task of the same user, so they
+// are answered at once. The users are compared by ID, since the names may be
+// changed or shared. The voice messages and the messages which do not talk to
+// AI are not coalesced.
+func (task *ChatTask) coalesce(bot *Bot, next Task) bool {
+	nextChat, ok := next.(*ChatTask)
+	if !ok || task.Audio != nil || nextChat.Audio != nil || task.UserID != nextChat.UserID {
+		return false
+	}
+	if !task.addressed(bot) || !nextChat.addressed(bot) {
+		return false
+	}
+
+	task.Message += "\n" + nextChat.Message
+	// reply to the latest event, whose reply token is not expired yet
+	task.Channel = nextChat.Channel
+	return true
+}
+
+func (task *ChatTask) SessionID() string {
+	return task.Session.ID
+}
+
+func (task *ChatTask) createChatCompletion(bot *Bot, req openai.ChatCompletionRequest) (string, error) {
+	msg, err := task.createChatCompletionMessage(bot, req)
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+	return msg.Content, nil
+}
+
+func (task *ChatTask) createChatCompletionMessage(bot *Bot, req openai.ChatCompletionRequest) (*openai.ChatCompletionMessage, error) {
+	cfg := bot.getConfig()
+	req.Stream = false
+	var resp openai.ChatCompletionResponse
+	ctx := context.Background()
+	err := task.callWithFallback(ctx, bot, req, func(completer ChatCompleter, req openai.ChatCompletionRequest) error {
+		// each attempt has the timeout of its own
+		attemptCtx := ctx
+		if cfg.RequestTimeout > 0 {
+			var cancel context.CancelFunc
+			attemptCtx, cancel = context.WithTimeout(ctx, cfg.RequestTimeout)
+			defer cancel()
 		}
+
+		var err error
+		resp, err = completer.CreateChatCompletion(attemptCtx, req)
+		return err
+	})
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+
+	if len(resp.Choices) == 0 {
+		return nil, errors.Error("chatgpt returns no choices")
+	}
+
+	return &resp.Choices[0].Message, nil
+}
+
+// reply answers the event the first time and pushes the following messages,
+// because some platforms only accept one reply per event.
+func (task *ChatTask) reply(reply *Reply) error {
+	if task.Channel == nil {
+		return nil
+	}
+
+	if task.replied {
+		return task.Channel.Push(reply)
 	}
+	task.replied = true
+	return task.Channel.Reply(reply)
+}
 
+func (task *ChatTask) replyContent(content string, audio *ReplyAudio) error {
+	log.Debug("replay message ...")
+	reply, urls := getImageUrlsFromReply(content)
+	urls = append(urls, task.images...)
+	task.images = nil
+	reply = strings.TrimSpace(reply)
+	if reply == "" && len(urls) == 0 && audio == nil {
+		return nil
+	}
+	if task.transcript != "" && !task.replied {
+		// show what the bot heard before the first answer
+		reply = fmt.Sprintf("🎤 %s\n\n%s", task.transcript, reply)
+	}
+
+	err := task.reply(&Reply{Text: reply, ImageUrls: urls, Audio: audio})
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
 	return nil
 }
 
+func (task *ChatTask) replyError(err error) error {
+	var err1 error
+	switch GetOpenAIErrCode(err) {
+	case 401:
+		err1 = task.reply(&Reply{Text: fmt.Sprintf("AI的token過期了，請聯繫管理員更新:\n%s", errors.GetErrorDetails(err))})
+	case 500:
+		err1 = task.reply(&Reply{Text: fmt.Sprintf("Server掛掉了，請聯繫管理員:\n%s", errors.GetErrorDetails(err))})
+	default:
+		err1 = task.reply(&Reply{Text: fmt.Sprintf("小愛壞掉了，可以嘗試輸入清空指令修復:\n%s", errors.GetErrorDetails(err))})
+	}
+
+	if err1 != nil {
+		return errors.ErrorAt(errors.Join(err, err1))
+	}
+	return errors.ErrorAt(err)
+}
+
 var reImgUrl = regexp.MustCompile(`https://image.pollinations.ai/prompt/[-a-zA-Z0-9@:%_\+,.~#?&//=\s]+`)
 
 func getImageUrlsFromReply(reply string) (string, []string) {
@@ -145,16 +362,21 @@ func getImageUrlsFromReply(reply string) (string, []string) {
 
 type ClearSessionTask struct {
 	Session *Session
-	ReplyFn func(reply string, imgUrls ...string) error
+	Channel Channel
+}
+
+func (task *ClearSessionTask) SessionID() string {
+	return task.Session.ID
 }
 
 func (task *ClearSessionTask) Do(bot *Bot) error {
 	log.Infof("clear session %s ...", task.Session.ID)
 	task.Session.Clear()
+	bot.sessMgr.SaveSession(task.Session)
 
-	if task.ReplyFn != nil {
-		log.Debug("reply message to line ...")
-		err := task.ReplyFn("已清空，小愛忘記了之前所有的對話")
+	if task.Channel != nil {
+		log.Debug("reply message ...")
+		err := task.Channel.Reply(&Reply{Text: "已清空，小愛忘記了之前所有的對話"})
 		if err != nil {
 			return errors.ErrorAt(err)
 		}
@@ -165,28 +387,59 @@ func (task *ClearSessionTask) Do(bot *Bot) error {
 type ChangeRoleTask struct {
 	Session *Session
 	Role    string
-	ReplyFn func(reply string, imgUrls ...string) error
+	Channel Channel
+}
+
+func (task *ChangeRoleTask) SessionID() string {
+	return task.Session.ID
 }
 
 func (task *ChangeRoleTask) Do(bot *Bot) error {
-	_, ok := bot.cfg.Roles[task.Role]
-	var msg string
+	cfg := bot.getConfig()
+	_, ok := cfg.Roles[task.Role]
+	reply := &Reply{}
 	if ok {
 		log.Infof("session(%s) 變更角色為<%s>", task.Session.ID, task.Role)
 		task.Session.ChangeRole(task.Role)
-		msg = fmt.Sprintf("小愛將扮演<%s>", task.Role)
+		bot.sessMgr.SaveSession(task.Session)
+		reply.Text = fmt.Sprintf("小愛將扮演<%s>", task.Role)
 	} else {
-		keys := maps.Keys(bot.cfg.Roles)
+		keys := maps.Keys(cfg.Roles)
 		slices.Sort(keys)
-		msg = fmt.Sprintf("角色不存在。\n您可以指定小愛扮演的角色如下:\n%s", strings.Join(keys, "\n"))
+		reply.Text = fmt.Sprintf("角色不存在。\n您可以指定小愛扮演的角色如下:\n%s", strings.Join(keys, "\n"))
+		if len(cfg.CmdsChangeRole) != 0 {
+			for _, key := range keys {
+				reply.QuickReplies = append(reply.QuickReplies, &QuickReply{Label: key, Text: cfg.CmdsChangeRole[0] + " " + key})
+			}
+		}
 	}
 
-	if task.ReplyFn != nil {
-		log.Debug("reply message to line ...")
-		err := task.ReplyFn(msg)
+	if task.Channel != nil {
+		log.Debug("reply message ...")
+		err := task.Channel.Reply(reply)
 		if err != nil {
 			return errors.ErrorAt(err)
 		}
 	}
 	return nil
 }
+
+// applyRoleParams sets the generation parameters of the role. Since the request
+// omits the zero temperature, zero is sent as the smallest positive number.
+func applyRoleParams(req *openai.ChatCompletionRequest, role *cfgs.Role) {
+	if role.Temperature != nil {
+		req.Temperature = max(*role.Temperature, math.SmallestNonzeroFloat32)
+	}
+	if role.TopP != nil {
+		req.TopP = max(*role.TopP, math.SmallestNonzeroFloat32)
+	}
+	req.MaxTokens = role.MaxTokens
+	req.PresencePenalty = role.PresencePenalty
+	req.FrequencyPenalty = role.FrequencyPenalty
+	req.Stop = role.Stop
+	if role.ResponseFormat != "" {
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatType(role.ResponseFormat),
+		}
+	}
+}
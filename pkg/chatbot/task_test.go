@@ -1,8 +1,11 @@
 package chatbot
 
 import (
+	"encoding/json"
 	"testing"
 
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,3 +18,44 @@ func Test_getImageUrlsFromReply(t *testing.T) {
 	assert.Equal(t, "@user:  這裡是您要的圖片 (圖1)  這是您喜歡的可愛小狗嗎？🐶", reply)
 	assert.Equal(t, []string{"https://image.pollinations.ai/prompt/a-photo-of-a-cute-puppy"}, urls)
 }
+
+func Test_messageMatchCmd(t *testing.T) {
+	msg, ok := messageMatchCmd("/clear", []string{"/clear"})
+	assert.True(t, ok)
+	assert.Equal(t, "/clear", msg)
+
+	msg, ok = messageMatchCmd("cosplay 數學家", []string{"/cosplay"})
+	assert.True(t, ok)
+	assert.Equal(t, "數學家", msg)
+
+	_, ok = messageMatchCmd("?", []string{"/clear"})
+	assert.False(t, ok)
+}
+
+func Test_applyRoleParams(t *testing.T) {
+	zero, topP := float32(0), float32(0.9)
+	req := openai.ChatCompletionRequest{}
+	applyRoleParams(&req, &cfgs.Role{
+		Temperature:    &zero,
+		TopP:           &topP,
+		MaxTokens:      100,
+		Stop:           []string{"END"},
+		ResponseFormat: "json_object",
+	})
+
+	data, err := json.Marshal(req)
+	assert.NoError(t, err)
+	params := map[string]any{}
+	assert.NoError(t, json.Unmarshal(data, &params))
+	assert.Contains(t, params, "temperature")
+	assert.InDelta(t, 0, params["temperature"], 1e-6)
+	assert.InDelta(t, 0.9, params["top_p"], 1e-6)
+	assert.EqualValues(t, 100, params["max_tokens"])
+	assert.Equal(t, []any{"END"}, params["stop"])
+	assert.Equal(t, map[string]any{"type": "json_object"}, params["response_format"])
+
+	req = openai.ChatCompletionRequest{}
+	applyRoleParams(&req, &cfgs.Role{})
+	assert.Zero(t, req.Temperature)
+	assert.Nil(t, req.ResponseFormat)
+}
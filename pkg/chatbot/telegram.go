@@ -0,0 +1,458 @@
+package chatbot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+)
+
+const telegramDefaultApiUrl = "https://api.telegram.org"
+
+const (
+	// telegramPollTimeout is how long getUpdates waits for the updates.
+	telegramPollTimeout = 30 * time.Second
+	// telegramHttpTimeout bounds the requests, it is longer than the poll.
+	telegramHttpTimeout = telegramPollTimeout + 30*time.Second
+)
+
+type telegramClient struct {
+	apiUrl     string
+	token      string
+	httpClient *http.Client
+}
+
+func newTelegramClient(botcfg *cfgs.Bot) (*telegramClient, error) {
+	if botcfg.TelegramToken == "" {
+		return nil, errors.Error("missing telegram token")
+	}
+
+	client := &telegramClient{}
+	client.apiUrl = strings.TrimSuffix(botcfg.TelegramApiUrl, "/")
+	if client.apiUrl == "" {
+		client.apiUrl = telegramDefaultApiUrl
+	}
+	client.token = botcfg.TelegramToken
+	client.httpClient = &http.Client{Timeout: telegramHttpTimeout}
+	return client, nil
+}
+
+type telegramResponse struct {
+	Ok          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	MessageID      int64            `json:"message_id"`
+	From           *telegramUser    `json:"from"`
+	Chat           telegramChat     `json:"chat"`
+	Text           string           `json:"text"`
+	Entities       []telegramEntity `json:"entities"`
+	ReplyToMessage *telegramMessage `json:"reply_to_message"`
+}
+
+type telegramUser struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+}
+
+type telegramChat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+type telegramEntity struct {
+	Type   string        `json:"type"`
+	Offset int           `json:"offset"`
+	Length int           `json:"length"`
+	User   *telegramUser `json:"user"`
+}
+
+func (client *telegramClient) call(ctx context.Context, method string, params any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+
+	url := fmt.Sprintf("%s/bot%s/%s", client.apiUrl, client.token, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return errors.ErrorAtf(err, "telegram %s failed", method)
+	}
+	defer resp.Body.Close()
+
+	tgResp := &telegramResponse{}
+	err = json.NewDecoder(resp.Body).Decode(tgResp)
+	if err != nil {
+		return errors.ErrorAtf(err, "telegram %s returns invalid response: %s", method, resp.Status)
+	}
+	if !tgResp.Ok {
+		return errors.Errorf("telegram %s failed: %d %s", method, tgResp.ErrorCode, tgResp.Description)
+	}
+
+	if result != nil {
+		err = json.Unmarshal(tgResp.Result, result)
+		if err != nil {
+			return errors.ErrorAt(err)
+		}
+	}
+
+	return nil
+}
+
+func (client *telegramClient) getMe(ctx context.Context) (*telegramUser, error) {
+	user := &telegramUser{}
+	err := client.call(ctx, "getMe", struct{}{}, user)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	return user, nil
+}
+
+func (client *telegramClient) getUpdates(ctx context.Context, offset int64, timeout time.Duration) ([]*telegramUpdate, error) {
+	updates := make([]*telegramUpdate, 0)
+	err := client.call(ctx, "getUpdates", gin.H{
+		"offset":          offset,
+		"timeout":         int(timeout.Seconds()),
+		"allowed_updates": []string{"message"},
+	}, &updates)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	return updates, nil
+}
+
+func (client *telegramClient) setWebhook(ctx context.Context, url, secretToken string) error {
+	params := gin.H{"url": url, "allowed_updates": []string{"message"}}
+	if secretToken != "" {
+		params["secret_token"] = secretToken
+	}
+	return client.call(ctx, "setWebhook", params, nil)
+}
+
+func (client *telegramClient) deleteWebhook(ctx context.Context) error {
+	return client.call(ctx, "deleteWebhook", struct{}{}, nil)
+}
+
+func (client *telegramClient) sendMessage(ctx context.Context, chatID int64, replyTo int64, reply *Reply) error {
+	if reply.Text != "" {
+		params := gin.H{"chat_id": chatID, "text": reply.Text}
+		if replyTo != 0 {
+			params["reply_parameters"] = gin.H{"message_id": replyTo, "allow_sending_without_reply": true}
+		}
+		if len(reply.QuickReplies) != 0 {
+			params["reply_markup"] = telegramReplyKeyboard(reply.QuickReplies)
+		}
+		err := client.call(ctx, "sendMessage", params, nil)
+		if err != nil {
+			return errors.ErrorAt(err)
+		}
+	}
+
+	for _, url := range reply.ImageUrls {
+		err := client.call(ctx, "sendPhoto", gin.H{"chat_id": chatID, "photo": url}, nil)
+		if err != nil {
+			return errors.ErrorAt(err)
+		}
+	}
+
+	if reply.Audio != nil {
+		params := gin.H{"chat_id": chatID, "audio": reply.Audio.Url}
+		if reply.Audio.Duration > 0 {
+			params["duration"] = int(reply.Audio.Duration.Seconds())
+		}
+		err := client.call(ctx, "sendAudio", params, nil)
+		if err != nil {
+			return errors.ErrorAt(err)
+		}
+	}
+
+	return nil
+}
+
+func (client *telegramClient) sendChatAction(ctx context.Context, chatID int64, action string) error {
+	return client.call(ctx, "sendChatAction", gin.H{"chat_id": chatID, "action": action}, nil)
+}
+
+func telegramReplyKeyboard(quickReplies []*QuickReply) gin.H {
+	keyboard := make([][]gin.H, 0, len(quickReplies))
+	for _, qr := range quickReplies {
+		keyboard = append(keyboard, []gin.H{{"text": qr.Text}})
+	}
+	return gin.H{
+		"keyboard":          keyboard,
+		"one_time_keyboard": true,
+		"resize_keyboard":   true,
+		"selective":         true,
+	}
+}
+
+type telegramMessenger struct {
+	router  Router
+	fpath   string
+	botcfg  *cfgs.Bot
+	client  *telegramClient
+	botName string
+}
+
+func newTelegramMessenger(router Router, fpath string, botcfg *cfgs.Bot) (*telegramMessenger, error) {
+	m := &telegramMessenger{}
+	m.router = router
+	m.fpath = fpath
+	m.botcfg = botcfg
+
+	client, err := newTelegramClient(botcfg)
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	m.client = client
+
+	me, err := client.getMe(context.Background())
+	if err != nil {
+		return nil, errors.ErrorAt(err)
+	}
+	m.botName = me.Username
+
+	if botcfg.TelegramMode != cfgs.TelegramModePoll && botcfg.TelegramWebhookUrl != "" {
+		err = client.setWebhook(context.Background(), botcfg.TelegramWebhookUrl, botcfg.TelegramSecretToken)
+		if err != nil {
+			return nil, errors.ErrorAt(err)
+		}
+	}
+
+	return m, nil
+}
+
+func (m *telegramMessenger) Platform() string {
+	return cfgs.PlatformTelegram
+}
+
+func (m *telegramMessenger) Handler() gin.HandlerFunc {
+	if m.botcfg.TelegramMode == cfgs.TelegramModePoll {
+		return nil
+	}
+	return m.telegramCallback
+}
+
+func (m *telegramMessenger) Run(stop <-chan struct{}) {
+	if m.botcfg.TelegramMode == cfgs.TelegramModePoll {
+		m.telegramPollUpdates(stop)
+	}
+}
+
+func (m *telegramMessenger) telegramCallback(c *gin.Context) {
+	if m.botcfg.TelegramSecretToken != "" && !secretEqual(c.GetHeader("X-Telegram-Bot-Api-Secret-Token"), m.botcfg.TelegramSecretToken) {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "invalid secret token"})
+		return
+	}
+
+	update := &telegramUpdate{}
+	err := c.ShouldBindJSON(update)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	m.telegramHandleUpdate(update)
+
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (m *telegramMessenger) telegramPollUpdates(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	err := m.client.deleteWebhook(ctx)
+	if err != nil {
+		log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to delete telegram webhook: %s", m.fpath)))
+	}
+
+	log.Infof("telegram bot %s start polling", m.fpath)
+	var offset int64
+	for {
+		updates, err := m.client.getUpdates(ctx, offset, telegramPollTimeout)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "unable to get telegram updates: %s", m.fpath)))
+			select {
+			case <-time.After(5 * time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			m.telegramHandleUpdate(update)
+		}
+	}
+}
+
+func (m *telegramMessenger) telegramHandleUpdate(update *telegramUpdate) {
+	message := update.Message
+	if message == nil || message.Text == "" {
+		// ignore other update and message types
+		return
+	}
+
+	ev := &Event{}
+	ev.BotPath = m.fpath
+	ev.ConversationID = strconv.FormatInt(message.Chat.ID, 10)
+	ev.UserName = telegramGetUserName(message.From)
+	if message.From != nil {
+		ev.UserID = strconv.FormatInt(message.From.ID, 10)
+	}
+	ev.BotName = m.botName
+	ev.IsGroup = telegramIsGroupMessage(message)
+	ev.Mentioned = telegramIsMentioned(message, m.botName)
+	ev.Mentions = telegramGetMentions(message)
+	ev.Text = telegramTrimCmdMention(strings.TrimLeftFunc(message.Text, unicode.IsSpace), m.botName)
+
+	m.router.Dispatch(ev, &telegramChannel{
+		client:  m.client,
+		chatID:  message.Chat.ID,
+		replyTo: message.MessageID,
+	})
+}
+
+type telegramChannel struct {
+	client  *telegramClient
+	chatID  int64
+	replyTo int64
+}
+
+func (ch *telegramChannel) Reply(reply *Reply) error {
+	err := ch.client.sendMessage(context.Background(), ch.chatID, ch.replyTo, reply)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	return nil
+}
+
+func (ch *telegramChannel) Push(reply *Reply) error {
+	err := ch.client.sendMessage(context.Background(), ch.chatID, 0, reply)
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	return nil
+}
+
+func (ch *telegramChannel) ShowLoading() error {
+	return ch.client.sendChatAction(context.Background(), ch.chatID, "typing")
+}
+
+func telegramGetUserName(user *telegramUser) string {
+	if user == nil {
+		return "路人甲"
+	}
+
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if name == "" {
+		name = user.Username
+	}
+	return name
+}
+
+func telegramIsGroupMessage(message *telegramMessage) bool {
+	switch message.Chat.Type {
+	case "group", "supergroup":
+		return true
+	}
+
+	return false
+}
+
+// telegramIsMentioned reports whether the message mentions the bot anywhere in
+// the text or replies to a message of the bot.
+func telegramIsMentioned(message *telegramMessage, botName string) bool {
+	if botName == "" {
+		return false
+	}
+
+	if reply := message.ReplyToMessage; reply != nil && reply.From != nil && reply.From.IsBot && strings.EqualFold(reply.From.Username, botName) {
+		return true
+	}
+
+	for _, mention := range telegramGetMentions(message) {
+		if strings.EqualFold(mention, botName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// telegramGetMentions returns the mentioned usernames without "@", or the user
+// ids for users without usernames.
+func telegramGetMentions(message *telegramMessage) []string {
+	mentions := make([]string, 0)
+	text := utf16.Encode([]rune(message.Text))
+	for _, entity := range message.Entities {
+		switch entity.Type {
+		case "mention":
+			if entity.Offset < 0 || entity.Offset+entity.Length > len(text) {
+				continue
+			}
+			mention := string(utf16.Decode(text[entity.Offset : entity.Offset+entity.Length]))
+			mentions = append(mentions, strings.TrimPrefix(mention, "@"))
+		case "text_mention":
+			if entity.User != nil {
+				mentions = append(mentions, strconv.FormatInt(entity.User.ID, 10))
+			}
+		}
+	}
+	return mentions
+}
+
+// telegramTrimCmdMention turns "/cmd@botname args" into "/cmd args".
+func telegramTrimCmdMention(msg, botName string) string {
+	if botName == "" || !strings.HasPrefix(msg, "/") {
+		return msg
+	}
+
+	cmd, args, _ := strings.Cut(msg, " ")
+	suffix := "@" + botName
+	if len(cmd) > len(suffix) && strings.EqualFold(cmd[len(cmd)-len(suffix):], suffix) {
+		cmd = cmd[:len(cmd)-len(suffix)]
+		if args == "" {
+			return cmd
+		}
+		return cmd + " " + args
+	}
+
+	return msg
+}
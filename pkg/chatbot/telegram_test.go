@@ -0,0 +1,131 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTelegramServer struct {
+	mu       sync.Mutex
+	updates  []string
+	messages []map[string]any
+}
+
+func (srv *fakeTelegramServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	switch method {
+	case "getMe":
+		fmt.Fprint(w, `{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"小愛","username":"gptbot"}}`)
+	case "getUpdates":
+		fmt.Fprintf(w, `{"ok":true,"result":[%s]}`, strings.Join(srv.updates, ","))
+		srv.updates = nil
+	case "sendMessage":
+		params := make(map[string]any)
+		json.NewDecoder(r.Body).Decode(&params)
+		srv.messages = append(srv.messages, params)
+		fmt.Fprint(w, `{"ok":true,"result":{}}`)
+	default:
+		fmt.Fprint(w, `{"ok":true,"result":true}`)
+	}
+}
+
+func TestTelegramPollUpdates(t *testing.T) {
+	srv := &fakeTelegramServer{}
+	srv.updates = []string{`{"update_id":7,"message":{"message_id":3,"from":{"id":2,"first_name":"Alice"},"chat":{"id":-100,"type":"group"},"text":"/clear@gptbot"}}`}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+
+	cfg := &cfgs.Config{
+		CmdsTalkToAI:     []string{"@ai"},
+		CmdsClearSession: []string{"/clear"},
+		CmdsChangeRole:   []string{"/cosplay"},
+		Bots: map[string]*cfgs.Bot{
+			"/telegram": {Platform: cfgs.PlatformTelegram, TelegramToken: "token", TelegramApiUrl: server.URL, TelegramMode: cfgs.TelegramModePoll},
+		},
+	}
+	bot := &Bot{stop: make(chan struct{})}
+	bot.cfg.Store(cfg)
+	bot.sessMgr = NewSessionManager(NewMemorySessionStore())
+	bot.taskQueue = NewTaskQueue(0)
+	messenger, err := newMessenger(bot, "/telegram", cfg.Bots["/telegram"])
+	assert.NoError(t, err)
+	assert.Nil(t, messenger.Handler())
+
+	go messenger.Run(bot.stop)
+	defer bot.Stop()
+
+	task, ok := bot.taskQueue.Pop()
+	assert.True(t, ok)
+	assert.IsType(t, &ClearSessionTask{}, task)
+	assert.Equal(t, "/telegram/-100", task.SessionID())
+
+	assert.NoError(t, task.Do(bot))
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	assert.Len(t, srv.messages, 1)
+	assert.Equal(t, float64(-100), srv.messages[0]["chat_id"])
+}
+
+func TestTelegramCallback_SecretToken(t *testing.T) {
+	server := httptest.NewServer(&fakeTelegramServer{})
+	defer server.Close()
+
+	cfg := &cfgs.Config{
+		Bots: map[string]*cfgs.Bot{
+			"/telegram": {Platform: cfgs.PlatformTelegram, TelegramToken: "token", TelegramApiUrl: server.URL, TelegramSecretToken: "secret"},
+		},
+	}
+	bot := &Bot{}
+	bot.cfg.Store(cfg)
+	bot.sessMgr = NewSessionManager(NewMemorySessionStore())
+	bot.taskQueue = NewTaskQueue(0)
+	messenger, err := newMessenger(bot, "/telegram", cfg.Bots["/telegram"])
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.POST("/telegram", messenger.Handler())
+	for _, secret := range []string{"", "wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodPost, "/telegram", strings.NewReader(`{"update_id":1}`))
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if secret == "secret" {
+			assert.Equal(t, http.StatusOK, w.Code)
+		} else {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+	}
+}
+
+func Test_telegramIsMentioned(t *testing.T) {
+	msg := &telegramMessage{
+		Text:     "嗨 @gptbot 你好",
+		Entities: []telegramEntity{{Type: "mention", Offset: 2, Length: 7}},
+	}
+	assert.True(t, telegramIsMentioned(msg, "gptbot"))
+	assert.False(t, telegramIsMentioned(msg, "otherbot"))
+
+	msg = &telegramMessage{
+		Text:           "繼續說",
+		ReplyToMessage: &telegramMessage{From: &telegramUser{IsBot: true, Username: "gptbot"}},
+	}
+	assert.True(t, telegramIsMentioned(msg, "gptbot"))
+}
+
+func Test_telegramTrimCmdMention(t *testing.T) {
+	assert.Equal(t, "/cosplay 數學家", telegramTrimCmdMention("/cosplay@gptbot 數學家", "gptbot"))
+	assert.Equal(t, "/clear", telegramTrimCmdMention("/clear@gptbot", "gptbot"))
+	assert.Equal(t, "/clear@other", telegramTrimCmdMention("/clear@other", "gptbot"))
+}
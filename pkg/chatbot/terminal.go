@@ -0,0 +1,152 @@
+package chatbot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+)
+
+// terminalMessenger is the messenger of `gptbot chat`, the events come from
+// Bot.Chat instead of a platform.
+type terminalMessenger struct{}
+
+func (m *terminalMessenger) Platform() string {
+	return cfgs.PlatformTerminal
+}
+
+func (m *terminalMessenger) Handler() gin.HandlerFunc {
+	return nil
+}
+
+func (m *terminalMessenger) Run(stop <-chan struct{}) {}
+
+// ReplyFn sends the reply to somewhere out of the chat platforms, e.g. the
+// terminal.
+type ReplyFn func(reply *Reply) error
+
+// funcChannel is the channel which sends the replies by a ReplyFn.
+type funcChannel struct {
+	reply ReplyFn
+}
+
+func (ch *funcChannel) Reply(reply *Reply) error {
+	return ch.reply(reply)
+}
+
+func (ch *funcChannel) Push(reply *Reply) error {
+	return ch.reply(reply)
+}
+
+func (ch *funcChannel) ShowLoading() error {
+	return nil
+}
+
+// ChatOptions are the options of Bot.Chat.
+type ChatOptions struct {
+	// BotPath is the bot to chat with, its DefaultRole is the role of the new
+	// sessions.
+	BotPath string
+	// UserName is the first speaker, `:user NAME` changes the speaker.
+	UserName string
+	// Group simulates a chat group which the users share, otherwise each user
+	// has a private chat.
+	Group bool
+}
+
+const chatHelp = `Commands of the terminal:
+    :user NAME    speak as another user
+    :help         show this help
+    :quit         exit
+The other lines are sent to the bot, including the chat commands like /clear.
+`
+
+// Chat reads the messages from in line by line and prints the replies to out.
+// The messages go through the same commands and tasks as the chat platforms.
+// The task queue must be running, e.g. by DoTasks.
+func (bot *Bot) Chat(in io.Reader, out io.Writer, opts *ChatOptions) error {
+	userName := opts.UserName
+	if userName == "" {
+		userName = "user"
+	}
+
+	ch := &funcChannel{reply: func(reply *Reply) error {
+		return printReply(out, reply)
+	}}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		fmt.Fprintf(out, "%s> ", userName)
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case line == ":quit", line == ":exit":
+			return nil
+		case line == ":help":
+			fmt.Fprint(out, chatHelp)
+			continue
+		case strings.HasPrefix(line, ":user "):
+			userName = strings.TrimSpace(strings.TrimPrefix(line, ":user "))
+			continue
+		}
+
+		ev := &Event{
+			BotPath:        opts.BotPath,
+			ConversationID: userName,
+			UserID:         userName,
+			UserName:       userName,
+			IsGroup:        opts.Group,
+			Text:           line,
+		}
+		if opts.Group {
+			ev.ConversationID = "group"
+		}
+		if !bot.Dispatch(ev, ch) {
+			continue
+		}
+		bot.taskQueue.WaitIdle()
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	return nil
+}
+
+func printReply(w io.Writer, reply *Reply) error {
+	sb := &strings.Builder{}
+	if reply.Text != "" {
+		fmt.Fprintf(sb, "🤖 %s\n", reply.Text)
+	}
+	for _, url := range reply.ImageUrls {
+		fmt.Fprintf(sb, "🖼️ %s\n", url)
+	}
+	if reply.Audio != nil {
+		fmt.Fprintf(sb, "🔊 %s (%v)\n", reply.Audio.Url, reply.Audio.Duration)
+	}
+	if len(reply.QuickReplies) != 0 {
+		labels := make([]string, 0, len(reply.QuickReplies))
+		for _, qr := range reply.QuickReplies {
+			labels = append(labels, qr.Text)
+		}
+		fmt.Fprintf(sb, "💡 %s\n", strings.Join(labels, " | "))
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	if err != nil {
+		return errors.ErrorAt(err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBot_Chat(t *testing.T) {
+	var lastMessages []openai.ChatCompletionMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := openai.ChatCompletionRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		lastMessages = req.Messages
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"你好"},"finish_reason":"stop"}]}`)
+	}))
+	defer server.Close()
+
+	cfg := newTestReloadConfig(t)
+	cfg.ChatGptApiUrl = server.URL
+	cfg.Roles["A"].PrefixUserName = true
+	cfg.Bots = map[string]*cfgs.Bot{"/terminal": {Platform: cfgs.PlatformTerminal, DefaultRole: "A"}}
+	bot, err := NewBot(cfg)
+	assert.NoError(t, err)
+	go bot.DoTasks()
+	defer bot.Stop()
+
+	in := strings.Join([]string{
+		"hello",
+		":user Bob",
+		"not for the bot",
+		"@ai hi",
+		"/clear",
+		":quit",
+		"never read",
+	}, "\n")
+	out := &strings.Builder{}
+	err = bot.Chat(strings.NewReader(in), out, &ChatOptions{BotPath: "/terminal", UserName: "Alice", Group: true})
+	assert.NoError(t, err)
+
+	assert.Equal(t, strings.Join([]string{
+		"Alice> Alice> Bob> Bob> 🤖 你好",
+		"Bob> 🤖 已清空，小愛忘記了之前所有的對話",
+		"Bob> ",
+	}, "\n"), out.String())
+
+	// hello is not sent in the group, since it does not talk to the bot
+	assert.Len(t, lastMessages, 2)
+	assert.Equal(t, "Bob: hi", lastMessages[1].Content)
+}
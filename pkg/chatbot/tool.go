@@ -0,0 +1,171 @@
+package chatbot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/sashabaranov/go-openai"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Tool is a function the model can call. Parameters returns the JSON schema of
+// the arguments, and Execute receives the arguments as a JSON string.
+type Tool interface {
+	Name() string
+	Description() string
+	Parameters() any
+	Execute(ctx context.Context, args string) (string, error)
+}
+
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	tools map[string]Tool
+}
+
+func NewToolRegistry() *ToolRegistry {
+	r := &ToolRegistry{}
+	r.tools = make(map[string]Tool)
+	return r
+}
+
+// DefaultToolRegistry returns a registry with the built-in tools.
+func DefaultToolRegistry() *ToolRegistry {
+	r := NewToolRegistry()
+	r.Register(&currentTimeTool{})
+	r.Register(&calculatorTool{})
+	r.Register(&searchHistoryTool{})
+	return r
+}
+
+func (r *ToolRegistry) Register(tool Tool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tools[tool.Name()] = tool
+}
+
+func (r *ToolRegistry) Get(name string) (Tool, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tool, ok := r.tools[name]
+	return tool, ok
+}
+
+func (r *ToolRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := maps.Keys(r.tools)
+	slices.Sort(names)
+	return names
+}
+
+// Definitions returns the tool definitions of the names for the chat completion
+// request, unknown names are skipped.
+func (r *ToolRegistry) Definitions(names []string) []openai.Tool {
+	defs := make([]openai.Tool, 0, len(names))
+	for _, name := range names {
+		tool, ok := r.Get(name)
+		if !ok {
+			log.Warnf("unknown tool: %s", name)
+			continue
+		}
+		defs = append(defs, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name(),
+				Description: tool.Description(),
+				Parameters:  tool.Parameters(),
+			},
+		})
+	}
+	return defs
+}
+
+type toolSessionKey struct{}
+
+// ToolSession returns the session which the tool is called for.
+func ToolSession(ctx context.Context) *Session {
+	s, _ := ctx.Value(toolSessionKey{}).(*Session)
+	return s
+}
+
+type toolTaskKey struct{}
+
+// toolAttachImage sends the image with the answer of the chat task, it returns
+// false if the tool is not called by a chat task.
+func toolAttachImage(ctx context.Context, url string) bool {
+	task, _ := ctx.Value(toolTaskKey{}).(*ChatTask)
+	if task == nil {
+		return false
+	}
+	task.images = append(task.images, url)
+	return true
+}
+
+// toolLimitScopes returns the limits of the chat task which calls the tool.
+func toolLimitScopes(ctx context.Context) []*limitScope {
+	task, _ := ctx.Value(toolTaskKey{}).(*ChatTask)
+	if task == nil {
+		return nil
+	}
+	return task.scopes
+}
+
+const maxToolRounds = 5
+
+// createChatCompletionWithTools sends the request with the tools of the role,
+// executes the tool calls and sends the results back until the model gives the
+// final answer. The tool calls and results are appended to the session.
+func (task *ChatTask) createChatCompletionWithTools(bot *Bot, req openai.ChatCompletionRequest, tools []openai.Tool) (string, error) {
+	req.Tools = tools
+	ctx := context.WithValue(context.Background(), toolSessionKey{}, task.Session)
+	ctx = context.WithValue(ctx, toolTaskKey{}, task)
+
+	for round := 0; round < maxToolRounds; round++ {
+		msg, err := task.createChatCompletionMessage(bot, req)
+		if err != nil {
+			return "", errors.ErrorAt(err)
+		}
+
+		if len(msg.ToolCalls) == 0 {
+			return msg.Content, nil
+		}
+
+		task.Session.AddMessage(msg)
+		req.Messages = append(req.Messages, *msg)
+		for _, call := range msg.ToolCalls {
+			result := bot.executeToolCall(ctx, call)
+			log.Infof("tool %s(%s): %s", call.Function.Name, call.Function.Arguments, result)
+			toolMsg := &openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    result,
+				Name:       call.Function.Name,
+				ToolCallID: call.ID,
+			}
+			task.Session.AddMessage(toolMsg)
+			req.Messages = append(req.Messages, *toolMsg)
+		}
+	}
+
+	// let the model answer with what it has
+	req.Tools = nil
+	return task.createChatCompletion(bot, req)
+}
+
+func (bot *Bot) executeToolCall(ctx context.Context, call openai.ToolCall) string {
+	tool, ok := bot.tools.Get(call.Function.Name)
+	if !ok {
+		return fmt.Sprintf("error: unknown tool %q", call.Function.Name)
+	}
+
+	result, err := tool.Execute(ctx, call.Function.Arguments)
+	if err != nil {
+		log.Warn(errors.GetErrorDetails(errors.ErrorAtf(err, "tool %s failed", call.Function.Name)))
+		return fmt.Sprintf("error: %v", err)
+	}
+
+	return result
+}
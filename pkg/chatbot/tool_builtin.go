@@ -0,0 +1,332 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+func decodeToolArgs(args string, v any) error {
+	if strings.TrimSpace(args) == "" {
+		return nil
+	}
+	err := json.Unmarshal([]byte(args), v)
+	if err != nil {
+		return errors.ErrorAtf(err, "invalid arguments: %s", args)
+	}
+	return nil
+}
+
+type currentTimeTool struct{}
+
+func (tool *currentTimeTool) Name() string {
+	return "current_time"
+}
+
+func (tool *currentTimeTool) Description() string {
+	return "Get the current date, time and weekday."
+}
+
+func (tool *currentTimeTool) Parameters() any {
+	return jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"timezone": {Type: jsonschema.String, Description: "IANA time zone name, e.g. Asia/Taipei. Default is the server time zone."},
+		},
+	}
+}
+
+func (tool *currentTimeTool) Execute(ctx context.Context, args string) (string, error) {
+	params := struct {
+		Timezone string `json:"timezone"`
+	}{}
+	err := decodeToolArgs(args, &params)
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+
+	now := time.Now()
+	if params.Timezone != "" {
+		loc, err := time.LoadLocation(params.Timezone)
+		if err != nil {
+			return "", errors.ErrorAt(err)
+		}
+		now = now.In(loc)
+	}
+
+	return fmt.Sprintf("%s %s", now.Format(time.RFC3339), now.Weekday()), nil
+}
+
+type calculatorTool struct{}
+
+func (tool *calculatorTool) Name() string {
+	return "calculator"
+}
+
+func (tool *calculatorTool) Description() string {
+	return "Evaluate an arithmetic expression with + - * / % ^ and parentheses."
+}
+
+func (tool *calculatorTool) Parameters() any {
+	return jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"expression": {Type: jsonschema.String, Description: "The expression, e.g. (1+2)*3^2"},
+		},
+		Required: []string{"expression"},
+	}
+}
+
+func (tool *calculatorTool) Execute(ctx context.Context, args string) (string, error) {
+	params := struct {
+		Expression string `json:"expression"`
+	}{}
+	err := decodeToolArgs(args, &params)
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+
+	v, err := evalExpression(params.Expression)
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64), nil
+}
+
+// evalExpression evaluates the arithmetic expression by recursive descent.
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = unary { ("*" | "/" | "%") unary }
+//	unary  = ("+" | "-") unary | power
+//	power  = atom [ "^" unary ]
+//	atom   = number | "(" expr ")"
+func evalExpression(expr string) (float64, error) {
+	p := &exprParser{src: []rune(expr)}
+	v, err := p.parseExpr()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return 0, errors.Errorf("unexpected %q at %d", string(p.src[p.pos]), p.pos)
+	}
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, errors.Errorf("invalid result of %q", expr)
+	}
+	return v, nil
+}
+
+type exprParser struct {
+	src []rune
+	pos int
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() rune {
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseExpr() (float64, error) {
+	v, err := p.parseTerm()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.peek() {
+		case '+':
+			p.pos++
+			rhs, err := p.parseTerm()
+			if err != nil {
+				return 0, err
+			}
+			v += rhs
+		case '-':
+			p.pos++
+			rhs, err := p.parseTerm()
+			if err != nil {
+				return 0, err
+			}
+			v -= rhs
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *exprParser) parseTerm() (float64, error) {
+	v, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return v, nil
+		}
+		p.pos++
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			v *= rhs
+		case '/':
+			if rhs == 0 {
+				return 0, errors.Error("division by zero")
+			}
+			v /= rhs
+		case '%':
+			if rhs == 0 {
+				return 0, errors.Error("division by zero")
+			}
+			v = math.Mod(v, rhs)
+		}
+	}
+}
+
+func (p *exprParser) parseUnary() (float64, error) {
+	switch p.peek() {
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	case '-':
+		p.pos++
+		v, err := p.parseUnary()
+		return -v, err
+	}
+	return p.parsePower()
+}
+
+func (p *exprParser) parsePower() (float64, error) {
+	v, err := p.parseAtom()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() == '^' {
+		p.pos++
+		exp, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		v = math.Pow(v, exp)
+	}
+	return v, nil
+}
+
+func (p *exprParser) parseAtom() (float64, error) {
+	if p.peek() == '(' {
+		p.pos++
+		v, err := p.parseExpr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, errors.Errorf("missing ) at %d", p.pos)
+		}
+		p.pos++
+		return v, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.src) && (unicode.IsDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos < len(p.src) {
+			return 0, errors.Errorf("unexpected %q at %d", string(p.src[p.pos]), p.pos)
+		}
+		return 0, errors.Error("unexpected end of expression")
+	}
+
+	v, err := strconv.ParseFloat(string(p.src[start:p.pos]), 64)
+	if err != nil {
+		return 0, errors.ErrorAt(err)
+	}
+	return v, nil
+}
+
+type searchHistoryTool struct{}
+
+func (tool *searchHistoryTool) Name() string {
+	return "search_history"
+}
+
+func (tool *searchHistoryTool) Description() string {
+	return "Search the earlier messages of this conversation by keyword."
+}
+
+func (tool *searchHistoryTool) Parameters() any {
+	return jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"keyword": {Type: jsonschema.String, Description: "The keyword to search, case insensitive."},
+			"limit":   {Type: jsonschema.Integer, Description: "Max count of the results, default is 5."},
+		},
+		Required: []string{"keyword"},
+	}
+}
+
+func (tool *searchHistoryTool) Execute(ctx context.Context, args string) (string, error) {
+	params := struct {
+		Keyword string `json:"keyword"`
+		Limit   int    `json:"limit"`
+	}{}
+	err := decodeToolArgs(args, &params)
+	if err != nil {
+		return "", errors.ErrorAt(err)
+	}
+	if params.Limit <= 0 {
+		params.Limit = 5
+	}
+
+	session := ToolSession(ctx)
+	if session == nil {
+		return "", errors.Error("no conversation")
+	}
+
+	keyword := strings.ToLower(params.Keyword)
+	msgs := session.GetMessages()
+	// skip the current turn which is asking
+	end := len(msgs)
+	for end > 0 && msgs[end-1].Role != openai.ChatMessageRoleUser {
+		end--
+	}
+	end--
+
+	results := make([]string, 0, params.Limit)
+	for i := end - 1; i >= 0 && len(results) < params.Limit; i-- {
+		msg := msgs[i]
+		if msg.Role != openai.ChatMessageRoleUser && msg.Role != openai.ChatMessageRoleAssistant {
+			continue
+		}
+		text := messageText(&msg)
+		if text != "" && strings.Contains(strings.ToLower(text), keyword) {
+			results = append(results, fmt.Sprintf("%s: %s", msg.Role, text))
+		}
+	}
+
+	if len(results) == 0 {
+		return "no message found", nil
+	}
+	return strings.Join(results, "\n"), nil
+}
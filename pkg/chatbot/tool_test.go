@@ -0,0 +1,61 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_evalExpression(t *testing.T) {
+	cases := map[string]float64{
+		"1+2*3":       7,
+		"(1+2)*3":     9,
+		"-2^2":        -4,
+		"2^3^2":       512,
+		"10 % 4 / 2":  1,
+		"1.5 * -(2)":  -3,
+		" 3 - 2 - 1 ": 0,
+	}
+	for expr, expected := range cases {
+		v, err := evalExpression(expr)
+		assert.NoError(t, err, expr)
+		assert.Equal(t, expected, v, expr)
+	}
+
+	for _, expr := range []string{"", "1+", "(1", "1/0", "2x"} {
+		_, err := evalExpression(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestChatTask_createChatCompletionWithTools(t *testing.T) {
+	round := 0
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		req := openai.ChatCompletionRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		round++
+		if round == 1 {
+			assert.Len(t, req.Tools, 1)
+			fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"calculator","arguments":"{\"expression\":\"6*7\"}"}}]}}]}`)
+			return
+		}
+		last := req.Messages[len(req.Messages)-1]
+		assert.Equal(t, openai.ChatMessageRoleTool, last.Role)
+		assert.Equal(t, "call_1", last.ToolCallID)
+		fmt.Fprintf(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"答案是 %s"}}]}`, last.Content)
+	})
+	bot.tools = DefaultToolRegistry()
+
+	task := &ChatTask{Session: NewSession("test", "test")}
+	task.Session.AddMessage(&openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "6乘7是多少"})
+	req := openai.ChatCompletionRequest{Messages: task.Session.GetMessages()}
+
+	content, err := task.createChatCompletionWithTools(bot, req, bot.tools.Definitions([]string{"calculator"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "答案是 42", content)
+	assert.Equal(t, 3, task.Session.Len())
+}
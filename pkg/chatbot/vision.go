@@ -0,0 +1,157 @@
+package chatbot
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jopbrown/gobase/errors"
+	"github.com/jopbrown/gobase/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+const maxImageSize = 10 << 20
+
+// AttachImageTask downloads the images and holds them in the session, they are
+// sent with the next message which talks to AI.
+type AttachImageTask struct {
+	Session     *Session
+	Attachments []*Attachment
+}
+
+func (task *AttachImageTask) SessionID() string {
+	return task.Session.ID
+}
+
+func (task *AttachImageTask) Do(bot *Bot) error {
+	for _, attachment := range task.Attachments {
+		if attachment.Type != AttachmentImage {
+			continue
+		}
+
+		url, err := readImageDataUrl(attachment)
+		if err != nil {
+			return errors.ErrorAt(err)
+		}
+
+		log.Infof("session(%s) hold image %s", task.Session.ID, attachment.ID)
+		task.Session.AddPendingImage(url)
+	}
+	return nil
+}
+
+func readImageDataUrl(attachment *Attachment) (string, error) {
+	r, err := attachment.Open()
+	if err != nil {
+		return "", errors.ErrorAtf(err, "unable to download image: %s", attachment.ID)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, maxImageSize+1))
+	if err != nil {
+		return "", errors.ErrorAtf(err, "unable to download image: %s", attachment.ID)
+	}
+	if len(data) > maxImageSize {
+		return "", errors.Errorf("image is too large: %s", attachment.ID)
+	}
+
+	mime := http.DetectContentType(data)
+	if !strings.HasPrefix(mime, "image/") {
+		return "", errors.Errorf("unsupported image type %s: %s", mime, attachment.ID)
+	}
+
+	return fmt.Sprintf("data:%s;base64,%s", mime, base64.StdEncoding.EncodeToString(data)), nil
+}
+
+func newImageMessage(role, text string, imgUrls []string) *openai.ChatCompletionMessage {
+	parts := make([]openai.ChatMessagePart, 0, 1+len(imgUrls))
+	parts = append(parts, openai.ChatMessagePart{
+		Type: openai.ChatMessagePartTypeText,
+		Text: text,
+	})
+	for _, url := range imgUrls {
+		parts = append(parts, openai.ChatMessagePart{
+			Type:     openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{URL: url, Detail: openai.ImageURLDetailAuto},
+		})
+	}
+
+	return &openai.ChatCompletionMessage{
+		Role:         role,
+		MultiContent: parts,
+	}
+}
+
+type pendingImage struct {
+	url  string
+	date time.Time
+}
+
+func (s *Session) AddPendingImage(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pendingImages = append(s.pendingImages, &pendingImage{url: url, date: time.Now()})
+}
+
+// TakePendingImages returns the images held in the period and forgets all of them.
+func (s *Session) TakePendingImages(period time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	urls := make([]string, 0, len(s.pendingImages))
+	for _, img := range s.pendingImages {
+		if period <= 0 || now.Sub(img.date) <= period {
+			urls = append(urls, img.url)
+		}
+	}
+	s.pendingImages = nil
+	return urls
+}
+
+// messageText returns the text of the message, images are shown as placeholders.
+func messageText(msg *openai.ChatCompletionMessage) string {
+	if len(msg.MultiContent) == 0 {
+		return msg.Content
+	}
+
+	texts := make([]string, 0, len(msg.MultiContent))
+	for _, part := range msg.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			texts = append(texts, part.Text)
+		case openai.ChatMessagePartTypeImageURL:
+			texts = append(texts, "[圖片]")
+		}
+	}
+	return strings.Join(texts, " ")
+}
+
+// hasImage reports whether any message carries an image.
+func hasImage(msgs []openai.ChatCompletionMessage) bool {
+	for _, msg := range msgs {
+		for _, part := range msg.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeImageURL {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripImages replaces the images of the messages with the placeholders of
+// messageText, so the data urls are neither saved nor sent again.
+func stripImages(msgs []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	stripped := make([]openai.ChatCompletionMessage, len(msgs))
+	for i, msg := range msgs {
+		if hasImage(msgs[i : i+1]) {
+			msg.Content = messageText(&msg)
+			msg.MultiContent = nil
+		}
+		stripped[i] = msg
+	}
+	return stripped
+}
@@ -0,0 +1,124 @@
+package chatbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jopbrown/gptbot/pkg/cfgs"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAttachment(t *testing.T, data []byte) *Attachment {
+	t.Helper()
+	return &Attachment{
+		Type: AttachmentImage,
+		ID:   "img1",
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+}
+
+func TestAttachImageTask(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 1, 1))))
+
+	s := NewSession("/linebot/U1234", "聊天機器人")
+	task := &AttachImageTask{
+		Session:     s,
+		Attachments: []*Attachment{newTestAttachment(t, buf.Bytes())},
+	}
+	assert.NoError(t, task.Do(nil))
+
+	urls := s.TakePendingImages(time.Minute)
+	assert.Len(t, urls, 1)
+	assert.True(t, strings.HasPrefix(urls[0], "data:image/png;base64,"))
+	assert.Empty(t, s.TakePendingImages(time.Minute))
+
+	task.Attachments = []*Attachment{newTestAttachment(t, []byte("not an image"))}
+	assert.Error(t, task.Do(nil))
+	assert.Empty(t, s.TakePendingImages(time.Minute))
+}
+
+func TestTakePendingImages_expired(t *testing.T) {
+	s := NewSession("/linebot/U1234", "聊天機器人")
+	s.AddPendingImage("data:old")
+	s.pendingImages[0].date = time.Now().Add(-time.Hour)
+	s.AddPendingImage("data:new")
+
+	assert.Equal(t, []string{"data:new"}, s.TakePendingImages(time.Minute))
+}
+
+func Test_newImageMessage(t *testing.T) {
+	msg := newImageMessage(openai.ChatMessageRoleUser, "這是什麼?", []string{"data:a", "data:b"})
+	assert.Len(t, msg.MultiContent, 3)
+	assert.Equal(t, "這是什麼? [圖片] [圖片]", messageText(msg))
+	assert.True(t, hasImage([]openai.ChatCompletionMessage{*msg}))
+
+	counter := NewTokenCounter("gpt-4o")
+	assert.Greater(t, counter.CountTokens([]openai.ChatCompletionMessage{*msg}), 2*tokensPerImage)
+}
+
+func Test_stripImages(t *testing.T) {
+	msgs := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "prompt"},
+		*newImageMessage(openai.ChatMessageRoleUser, "這是什麼?", []string{"data:a"}),
+	}
+	assert.Equal(t, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "prompt"},
+		{Role: openai.ChatMessageRoleUser, Content: "這是什麼? [圖片]"},
+	}, stripImages(msgs))
+	assert.True(t, hasImage(msgs))
+}
+
+func TestChatTask_pendingImages(t *testing.T) {
+	var reqs []openai.ChatCompletionRequest
+	bot := newTestGptBot(t, func(w http.ResponseWriter, r *http.Request) {
+		req := openai.ChatCompletionRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		reqs = append(reqs, req)
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"一隻貓"}}]}`)
+	})
+	bot.cfg.Store(&cfgs.Config{
+		ChatGptModel: "gpt-3.5-turbo",
+		LogPath:      t.TempDir(),
+		Roles: cfgs.Roles{
+			"text":   &cfgs.Role{},
+			"vision": &cfgs.Role{VisionModel: "gpt-4o"},
+		},
+	})
+	bot.sessMgr = NewSessionManager(NewMemorySessionStore())
+
+	// the role without the vision model does not get the images
+	task := &ChatTask{UserName: "user", Session: NewSession("test", "text"), Message: "這是什麼?"}
+	task.Session.AddPendingImage("data:a")
+	assert.NoError(t, task.Do(bot))
+	assert.False(t, hasImage(reqs[0].Messages))
+	assert.Equal(t, "gpt-3.5-turbo", reqs[0].Model)
+	assert.Empty(t, task.Session.TakePendingImages(0))
+
+	// the images are sent once and not kept in the history
+	task = &ChatTask{UserName: "user", Session: NewSession("test", "vision"), Message: "這是什麼?"}
+	task.Session.AddPendingImage("data:a")
+	assert.NoError(t, task.Do(bot))
+	assert.True(t, hasImage(reqs[1].Messages))
+	assert.Equal(t, "gpt-4o", reqs[1].Model)
+	assert.Equal(t, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: "這是什麼? [圖片]"},
+		{Role: openai.ChatMessageRoleAssistant, Content: "一隻貓"},
+	}, task.Session.GetMessages())
+
+	task.Message = "牠在做什麼?"
+	assert.NoError(t, task.Do(bot))
+	assert.False(t, hasImage(reqs[2].Messages))
+	assert.Equal(t, "gpt-3.5-turbo", reqs[2].Model)
+}